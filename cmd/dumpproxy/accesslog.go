@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"time"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+var logFormat = flag.String(
+	"log-format", logFormatJSON,
+	"access log format: json (one object per line) or text",
+)
+
+var accessLog = log.New(os.Stderr, "", 0)
+
+// accessLogEntry is an access log line in JSON format.
+type accessLogEntry struct {
+	Time              string  `json:"time"`
+	RequestID         string  `json:"request_id"`
+	Host              string  `json:"host"`
+	RemoteAddr        string  `json:"remote_addr"`
+	Method            string  `json:"method"`
+	URL               string  `json:"url"`
+	Status            int     `json:"status"`
+	DurationMS        float64 `json:"duration_ms"`
+	UpstreamLatencyMS float64 `json:"upstream_latency_ms,omitempty"`
+	DumpPrefix        string  `json:"dump_prefix,omitempty"`
+	Error             string  `json:"error,omitempty"`
+}
+
+func validLogFormat(format string) bool {
+	return format == logFormatJSON || format == logFormatText
+}
+
+func writeAccessLog(
+	r *http.Request,
+	statusCode int,
+	fNamePrefix string,
+	duration, upstreamTime time.Duration,
+	err error,
+) {
+	u := exchangeOf(r.Context()).rules.redaction.redactURL(r.URL.String())
+	if *logFormat == logFormatText {
+		log.Printf(
+			"%v %v %v %v %v",
+			r.Host,
+			extractAddr(r.RemoteAddr),
+			statusCode,
+			u,
+			fNamePrefix,
+		)
+		if err != nil {
+			log.Print(err)
+		}
+		return
+	}
+
+	entry := accessLogEntry{
+		Time:              time.Now().Format(time.RFC3339Nano),
+		RequestID:         requestID(r),
+		Host:              r.Host,
+		RemoteAddr:        extractAddr(r.RemoteAddr),
+		Method:            r.Method,
+		URL:               u,
+		Status:            statusCode,
+		DurationMS:        milliseconds(duration),
+		UpstreamLatencyMS: milliseconds(upstreamTime),
+		DumpPrefix:        fNamePrefix,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	accessLog.Print(string(data))
+}
+
+const headerRequestID = "X-Request-Id"
+
+// withRequestID sets a random X-Request-Id on requests that came without
+// one before h handles them, so the upstream, dumps, metadata and log
+// lines of a request share the ID.
+func withRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(headerRequestID) == "" {
+			var id [8]byte
+			_, _ = rand.Read(id[:])
+			r.Header.Set(headerRequestID, hex.EncodeToString(id[:]))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestID returns the X-Request-Id of the request, see withRequestID.
+func requestID(r *http.Request) string {
+	return r.Header.Get(headerRequestID)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var adminAddr = flag.String(
+	"admin-addr", "",
+	"address to serve UI and JSON API for browsing dumps, disabled if empty",
+)
+
+// maxShownBody limits bodies rendered on the exchange page, full bodies
+// are available as raw files.
+const maxShownBody = 1024 * 1024
+
+// dumpParts are the dump files of an exchange served by the admin API.
+var dumpParts = map[string]string{
+	"request_headers":  suffixReqHeaders,
+	"request_body":     suffixReqBody,
+	"response_headers": suffixRespHeaders,
+	"response_body":    suffixRespBody,
+	"ws_frames":        suffixWSFrames,
+}
+
+// admin serves dumps of dir or, if the dir parameter of a request picks
+// it, of another dump directory of routes.
+type admin struct {
+	dir  string
+	dirs func() []string
+}
+
+func newAdminHandler(dir string, dirs func() []string) http.Handler {
+	a := &admin{dir: dir, dirs: dirs}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.index)
+	mux.HandleFunc("/exchanges/", a.exchangePage)
+	mux.HandleFunc("/api/exchanges", a.apiList)
+	mux.HandleFunc("/api/exchanges/", a.apiExchange)
+	mux.HandleFunc("/api/search", a.apiSearch)
+	mux.HandleFunc("/metrics", serveMetrics)
+	return mux
+}
+
+func runAdmin(addr, dir string) {
+	log.Printf("admin: listening on %v", addr)
+	dirs := func() []string { return routeDirs(currentRoutes()) }
+	log.Print(http.ListenAndServe(addr, newAdminHandler(dir, dirs)))
+}
+
+// dumpDir returns the dump directory picked by the dir parameter of r, ok
+// is false if no route dumps to it.
+func (a *admin) dumpDir(r *http.Request) (dir string, ok bool) {
+	dir = r.URL.Query().Get("dir")
+	if dir == "" || dir == a.dir {
+		return a.dir, true
+	}
+	for _, d := range a.dirs() {
+		if d == dir {
+			return d, true
+		}
+	}
+	return "", false
+}
+
+// exchanges returns metadata of exchanges dumped to dir, newest first.
+func (a *admin) exchanges(
+	r *http.Request,
+	dir string,
+) ([]*exchangeMeta, error) {
+	metas, err := listMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(metas)-1; i < j; i, j = i+1, j-1 {
+		metas[i], metas[j] = metas[j], metas[i]
+	}
+
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+	if len(metas) > limit {
+		metas = metas[:limit]
+	}
+	return metas, nil
+}
+
+// exchangeMeta returns metadata of the exchange with the given ID dumped
+// to dir or nil if the ID is unknown.
+func (a *admin) exchangeMeta(dir, id string) *exchangeMeta {
+	if id == "" || id != path.Base(id) || strings.HasPrefix(id, ".") {
+		return nil
+	}
+	meta, err := loadMeta(dir, id)
+	if err != nil {
+		return nil
+	}
+	return meta
+}
+
+func (a *admin) apiList(w http.ResponseWriter, r *http.Request) {
+	dir, ok := a.dumpDir(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	metas, err := a.exchanges(r, dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, metas)
+}
+
+type exchangeDetails struct {
+	*exchangeMeta
+	RequestHeaders  string            `json:"request_headers"`
+	ResponseHeaders string            `json:"response_headers"`
+	Files           map[string]string `json:"files"`
+}
+
+func (a *admin) details(dir string, meta *exchangeMeta) *exchangeDetails {
+	prefix := exchangePrefix(dir, meta.ID)
+	d := &exchangeDetails{exchangeMeta: meta, Files: make(map[string]string)}
+	reqHeaders, _ := ioutil.ReadFile(prefix + suffixReqHeaders)
+	d.RequestHeaders = string(reqHeaders)
+	respHeaders, _ := ioutil.ReadFile(prefix + suffixRespHeaders)
+	d.ResponseHeaders = string(respHeaders)
+	for part, suffix := range dumpParts {
+		if _, err := os.Stat(prefix + suffix); err == nil {
+			d.Files[part] = "/api/exchanges/" + meta.ID + "/" + part +
+				"?dir=" + url.QueryEscape(dir)
+		}
+	}
+	return d
+}
+
+// apiExchange serves /api/exchanges/<id> with exchange details and
+// /api/exchanges/<id>/<part> with raw dump files.
+func (a *admin) apiExchange(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/exchanges/"), "/")
+	dir, ok := a.dumpDir(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	meta := a.exchangeMeta(dir, parts[0])
+	if meta == nil || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if len(parts) == 1 {
+		writeJSON(w, a.details(dir, meta))
+		return
+	}
+
+	suffix, ok := dumpParts[parts[1]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	a.serveDumpFile(w, r, exchangePrefix(dir, meta.ID)+suffix)
+}
+
+func (a *admin) serveDumpFile(w http.ResponseWriter, r *http.Request, fName string) {
+	f, err := os.Open(fName)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer closeLogError(f)
+
+	// Dumps are never rendered by the browser as they came, an HTML body
+	// would run on the admin origin.
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.URL.Query().Get("download") != "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set(
+			"Content-Disposition",
+			"attachment; filename="+strconv.Quote(path.Base(fName)),
+		)
+		_, err = io.Copy(w, f)
+		logAdminError(err)
+		return
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("pretty") != "" {
+		data = prettyJSON(data)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = w.Write(data)
+	logAdminError(err)
+}
+
+// prettyJSON indents data if it's a JSON document and returns it as is
+// otherwise.
+func prettyJSON(data []byte) []byte {
+	var buf bytes.Buffer
+	if json.Indent(&buf, data, "", "  ") != nil {
+		return data
+	}
+	return buf.Bytes()
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	logAdminError(enc.Encode(v))
+}
+
+func logAdminError(err error) {
+	if err != nil {
+		log.Printf("admin: %v", err)
+	}
+}
+
+func (a *admin) index(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	dir, ok := a.dumpDir(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	metas, err := a.exchanges(r, dir)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	dirs := []string{a.dir}
+	for _, d := range a.dirs() {
+		if d != a.dir {
+			dirs = append(dirs, d)
+		}
+	}
+	logAdminError(indexTmpl.Execute(w, map[string]interface{}{
+		"Dir":       dir,
+		"Dirs":      dirs,
+		"Exchanges": metas,
+	}))
+}
+
+type shownBody struct {
+	Text      string
+	Binary    bool
+	Truncated bool
+}
+
+func (a *admin) exchangePage(w http.ResponseWriter, r *http.Request) {
+	dir, ok := a.dumpDir(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	meta := a.exchangeMeta(dir, strings.TrimPrefix(r.URL.Path, "/exchanges/"))
+	if meta == nil {
+		http.NotFound(w, r)
+		return
+	}
+	prefix := exchangePrefix(dir, meta.ID)
+	logAdminError(exchangeTmpl.Execute(w, map[string]interface{}{
+		"Dir":          dir,
+		"Exchange":     a.details(dir, meta),
+		"RequestBody":  showBody(prefix + suffixReqBody),
+		"ResponseBody": showBody(prefix + suffixRespBody),
+	}))
+}
+
+func showBody(fName string) *shownBody {
+	f, err := os.Open(fName)
+	if err != nil {
+		return nil
+	}
+	defer closeLogError(f)
+
+	data, err := ioutil.ReadAll(io.LimitReader(f, maxShownBody+1))
+	if err != nil {
+		return &shownBody{Text: err.Error()}
+	}
+	body := &shownBody{}
+	if len(data) > maxShownBody {
+		data = data[:maxShownBody]
+		body.Truncated = true
+	} else {
+		data = prettyJSON(data)
+	}
+	if !utf8.Valid(data) {
+		body.Binary = true
+		return body
+	}
+	body.Text = string(data)
+	return body
+}
+
+const adminStyle = `<style>
+body { font-family: sans-serif; font-size: 14px; }
+table { border-collapse: collapse; }
+td, th { padding: 2px 8px; text-align: left; border-bottom: 1px solid #ddd; }
+pre { background: #f6f6f6; padding: 8px; overflow: auto; }
+</style>`
+
+var indexTmpl = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html><head><title>dumpproxy</title>` + adminStyle + `</head><body>
+<h1>Exchanges in {{.Dir}}</h1>
+{{if gt (len .Dirs) 1}}<p>Dump directories: {{range .Dirs}}
+<a href="/?dir={{.}}">{{.}}</a>{{end}}</p>{{end}}
+<table>
+<tr><th>Time</th><th>Method</th><th>URL</th><th>Status</th>
+<th>Request</th><th>Response</th><th>Duration, ms</th><th>Tags</th></tr>
+{{$dir := .Dir}}{{range .Exchanges}}<tr>
+<td><a href="/exchanges/{{.ID}}?dir={{$dir}}">{{.Started.Format "2006-01-02 15:04:05"}}</a></td>
+<td>{{.Method}}</td><td>{{.URL}}</td><td>{{.Status}}</td>
+<td>{{.RequestSize}}</td><td>{{.ResponseSize}}</td>
+<td>{{printf "%.1f" .DurationMS}}</td>
+<td>{{range .Tags}}{{.}} {{end}}{{if .Archive}}(archived){{end}}</td>
+</tr>{{end}}
+</table>
+</body></html>
+`))
+
+var exchangeTmpl = template.Must(template.New("exchange").Parse(`<!DOCTYPE html>
+<html><head><title>{{.Exchange.ID}}</title>` + adminStyle + `</head><body>
+{{with .Exchange}}
+<p><a href="/?dir={{$.Dir}}">All exchanges</a></p>
+<h1>{{.Method}} {{.URL}}</h1>
+<p>{{.ID}}, status {{.Status}}, {{printf "%.1f" .DurationMS}} ms</p>
+{{if .Archive}}<p>Archived to {{.Archive}}</p>{{end}}
+{{range .Faults}}<p>Injected fault: {{.}}</p>{{end}}
+{{range .Notes}}<p>Note: {{.}}</p>{{end}}
+{{if .Tags}}<p>Tags: {{range .Tags}}{{.}} {{end}}</p>{{end}}
+<p>Files: {{range $part, $url := .Files}}
+<a href="{{$url}}">{{$part}}</a> (<a href="{{$url}}&amp;download=1">download</a>)
+{{end}}</p>
+<h2>Request</h2>
+<pre>{{.RequestHeaders}}</pre>
+{{end}}
+{{template "body" .RequestBody}}
+<h2>Response</h2>
+<pre>{{.Exchange.ResponseHeaders}}</pre>
+{{template "body" .ResponseBody}}
+</body></html>
+{{define "body"}}{{if .}}{{if .Binary}}<p>Binary body, see raw file.</p>
+{{else if .Text}}<pre>{{.Text}}</pre>{{end}}
+{{if .Truncated}}<p>Body is truncated, see raw file.</p>{{end}}{{end}}{{end}}
+`))
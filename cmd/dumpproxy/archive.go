@@ -0,0 +1,264 @@
+package main
+
+import (
+	"archive/tar"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+var archiveAfter = flag.Duration(
+	"archive-after", 0,
+	"pack exchanges older than this into archives, 0 disables archiving",
+)
+var archiveInterval = flag.Duration(
+	"archive-interval", 10*time.Minute, "how often to look for old exchanges",
+)
+var archiveDir = flag.String(
+	"archive-dir", "",
+	"directory to store archives in, a subdirectory per dump directory "+
+		"(default <dir>/archive)",
+)
+var archiveUploadURL = flag.String(
+	"archive-upload-url", "",
+	"upload archives with HTTP PUT to this URL followed by the archive name",
+)
+
+// archiveSuffix ends names of archives, they are zstd compressed
+// tarballs.
+const archiveSuffix = ".tar.zst"
+
+// archiveDirOf returns the directory archives of exchanges from dir go to.
+// Dump directories sharing -archive-dir get subdirectories named after
+// their absolute paths, e.g. srv_dumps for /srv/dumps, so retention of
+// one directory only sees its own archives.
+func archiveDirOf(dir string) string {
+	if *archiveDir != "" {
+		return path.Join(*archiveDir, archiveSubdir(dir))
+	}
+	return path.Join(dir, "archive")
+}
+
+func archiveSubdir(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		dir = filepath.ToSlash(abs)
+	}
+	return strings.Replace(strings.Trim(dir, "/"), "/", "_", -1)
+}
+
+// runArchiver periodically packs old exchanges from dir into dated
+// archives.
+func runArchiver(dir string) {
+	ticker := time.NewTicker(*archiveInterval)
+	defer ticker.Stop()
+	for {
+		if err := archiveOnce(dir, time.Now().Add(-*archiveAfter)); err != nil {
+			log.Printf("archiver: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func archiveOnce(dir string, cutoff time.Time) error {
+	ids, err := listExchanges(dir)
+	if err != nil {
+		return err
+	}
+
+	var old []string
+	for _, id := range ids {
+		modTime, err := exchangeModTime(exchangePrefix(dir, id))
+		if err != nil {
+			return err
+		}
+		if modTime.Before(cutoff) {
+			old = append(old, id)
+		}
+	}
+	if len(old) == 0 {
+		return nil
+	}
+
+	aDir := archiveDirOf(dir)
+	if err := os.MkdirAll(aDir, 0777); err != nil {
+		return err
+	}
+
+	aName := path.Join(
+		aDir, "dumps-"+time.Now().Format("2006-01-02-15-04-05")+archiveSuffix,
+	)
+	if err := writeArchive(aName, dir, old); err != nil {
+		if rmErr := os.Remove(aName); rmErr != nil && !os.IsNotExist(rmErr) {
+			log.Print(rmErr)
+		}
+		return err
+	}
+
+	var aURL string
+	if *archiveUploadURL != "" {
+		aURL = strings.TrimSuffix(*archiveUploadURL, "/") + "/"
+		if *archiveDir != "" {
+			// Uploads of different dump directories are kept apart.
+			aURL += archiveSubdir(dir) + "/"
+		}
+		aURL += path.Base(aName)
+		if err := uploadArchive(aURL, aName); err != nil {
+			// Keep the local archive, the upload is best effort.
+			log.Printf("archiver: upload %v: %v", aName, err)
+			aURL = ""
+		}
+	}
+
+	for _, id := range old {
+		meta, err := loadMeta(dir, id)
+		if err != nil {
+			return err
+		}
+		meta.Archive = aName
+		meta.ArchiveURL = aURL
+		if err := saveMeta(dir, meta); err != nil {
+			return err
+		}
+		removeExchange(exchangePrefix(dir, id))
+	}
+	log.Printf("archiver: packed %v exchanges into %v", len(old), aName)
+	return nil
+}
+
+// exchangeModTime returns the time of the last write to any of the dump
+// files of the exchange.
+func exchangeModTime(dumpFilePrefix string) (time.Time, error) {
+	var modTime time.Time
+	for _, suffix := range allDumpSuffixes() {
+		fi, err := os.Stat(dumpFilePrefix + suffix)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return modTime, err
+		}
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+	return modTime, nil
+}
+
+func writeArchive(aName, dir string, ids []string) error {
+	f, err := os.OpenFile(aName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return err
+	}
+	zw, err := zstd.NewWriter(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	tw := tar.NewWriter(zw)
+	abort := func() {
+		_ = zw.Close()
+		_ = f.Close()
+	}
+
+	for _, id := range ids {
+		prefix := exchangePrefix(dir, id)
+		for _, suffix := range allDumpSuffixes() {
+			if err = addToArchive(tw, prefix+suffix); err != nil {
+				abort()
+				return err
+			}
+		}
+		if err = addToArchive(tw, prefix+suffixMeta); err != nil {
+			abort()
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		abort()
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func addToArchive(tw *tar.Writer, fName string) error {
+	f, err := os.Open(fName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closeLogError(f)
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr, err := tar.FileInfoHeader(fi, "")
+	if err != nil {
+		return err
+	}
+	if err = tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func uploadArchive(url, aName string) error {
+	f, err := os.Open(aName)
+	if err != nil {
+		return err
+	}
+	defer closeLogError(f)
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPut, url, f)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = fi.Size()
+	req.Header.Set("Content-Type", "application/zstd")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer closeLogError(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// removeExchange deletes all dump files of the exchange except metadata.
+func removeExchange(dumpFilePrefix string) {
+	for _, suffix := range allDumpSuffixes() {
+		err := os.Remove(dumpFilePrefix + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	incompleteQuarantine = "quarantine"
+	incompleteDelete     = "delete"
+	incompleteKeep       = "keep"
+)
+
+var incompleteAction = flag.String(
+	"incomplete", incompleteQuarantine,
+	"what to do with incomplete dumps found on startup or left by failed "+
+		"exchanges: quarantine, delete or keep",
+)
+
+const quarantineDirName = "incomplete"
+const cleanupLogName = "cleanup.log"
+
+var cleanupLogMu sync.Mutex
+
+func validIncompleteAction(action string) bool {
+	switch action {
+	case incompleteQuarantine, incompleteDelete, incompleteKeep:
+		return true
+	}
+	return false
+}
+
+// cleanupIncomplete finds exchanges in dir that never completed, e.g.
+// because the proxy crashed, and discards them.
+func cleanupIncomplete(dir string) error {
+	if *incompleteAction == incompleteKeep {
+		return nil
+	}
+
+	prefixes := make(map[string]struct{})
+	for _, suffix := range allDumpSuffixes() {
+		fNames, err := globDumps(dir, suffix)
+		if err != nil {
+			return err
+		}
+		for _, fName := range fNames {
+			prefixes[strings.TrimSuffix(fName, suffix)] = struct{}{}
+		}
+	}
+
+	sorted := make([]string, 0, len(prefixes))
+	for prefix := range prefixes {
+		sorted = append(sorted, prefix)
+	}
+	sort.Strings(sorted)
+
+	for _, prefix := range sorted {
+		if reason := incompleteReason(prefix); reason != "" {
+			exchangeDir, id := path.Split(prefix)
+			discardExchange(exchangeDir, id, reason)
+		}
+	}
+	return nil
+}
+
+// incompleteReason returns why the exchange can't be trusted or an empty
+// string if all its dump files are in place. Bodies may legitimately be
+// empty, headers may not.
+func incompleteReason(dumpFilePrefix string) string {
+	for _, suffix := range dumpSuffixes {
+		fi, err := os.Stat(dumpFilePrefix + suffix)
+		if os.IsNotExist(err) {
+			return "missing " + suffix
+		}
+		if err != nil {
+			return err.Error()
+		}
+		if fi.Size() == 0 &&
+			(suffix == suffixReqHeaders || suffix == suffixRespHeaders) {
+			return "empty " + suffix
+		}
+	}
+	return ""
+}
+
+// discardExchange quarantines or deletes dump files of the exchange
+// according to -incomplete and records it in the cleanup log.
+func discardExchange(dir, id, reason string) {
+	action := *incompleteAction
+	if action == incompleteKeep {
+		return
+	}
+
+	quarantineDir := path.Join(dir, quarantineDirName)
+	if action == incompleteQuarantine {
+		if err := os.MkdirAll(quarantineDir, 0777); err != nil {
+			log.Print(err)
+			return
+		}
+	}
+
+	for _, suffix := range append(allDumpSuffixes(), suffixMeta) {
+		fName := path.Join(dir, id+suffix)
+		var err error
+		if action == incompleteQuarantine {
+			err = os.Rename(fName, path.Join(quarantineDir, id+suffix))
+		} else {
+			err = os.Remove(fName)
+		}
+		if err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+
+	log.Printf("%v incomplete exchange %v: %v", action, id, reason)
+	recordCleanup(dir, fmt.Sprintf(
+		"%v\t%v\t%v\t%v\n",
+		time.Now().Format(time.RFC3339), action, id, reason,
+	))
+}
+
+func recordCleanup(dir, line string) {
+	cleanupLogMu.Lock()
+	defer cleanupLogMu.Unlock()
+
+	f, err := os.OpenFile(
+		path.Join(dir, cleanupLogName),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666,
+	)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	defer closeLogError(f)
+
+	if _, err = f.WriteString(line); err != nil {
+		log.Print(err)
+	}
+}
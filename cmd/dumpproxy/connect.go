@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/olomix/dumpproxy"
+)
+
+var forwardProxy = flag.Bool(
+	"forward-proxy", false,
+	"also act as a forward proxy: serve absolute-form requests and CONNECT "+
+		"tunnels by going to the requested host, which lets anyone who can "+
+		"reach -listen-addr reach any host",
+)
+var mitmCACertFile = flag.String(
+	"mitm-ca-cert", "",
+	"CA certificate to sign per-host certificates and decrypt CONNECT "+
+		"tunnels, tunnels are relayed blindly if not set",
+)
+var mitmCAKeyFile = flag.String(
+	"mitm-ca-key", "", "private key file for -mitm-ca-cert",
+)
+
+// maxMITMCerts limits generated certificates kept for reuse, the oldest
+// ones are dropped first.
+const maxMITMCerts = 1000
+
+var (
+	mitmCA      *tls.Certificate
+	mitmLeafKey *ecdsa.PrivateKey
+	mitmCertsMu sync.Mutex
+	mitmCerts   = make(map[string]*tls.Certificate)
+	// mitmHosts are keys of mitmCerts in the order they were added.
+	mitmHosts []string
+)
+
+func loadMITMCA(certFile, keyFile string) error {
+	ca, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	ca.Leaf, err = x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return err
+	}
+	if !ca.Leaf.IsCA {
+		return fmt.Errorf("%v is not a CA certificate", certFile)
+	}
+
+	// All generated certificates share one key, generating a key per host
+	// would slow down every first request to a host.
+	mitmLeafKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	mitmCA = &ca
+	return nil
+}
+
+// mitmCertificate returns a certificate for host signed by the MITM CA.
+func mitmCertificate(host string) (*tls.Certificate, error) {
+	mitmCertsMu.Lock()
+	defer mitmCertsMu.Unlock()
+
+	if cert, ok := mitmCerts[host]; ok {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(
+		rand.Reader, tmpl, mitmCA.Leaf, &mitmLeafKey.PublicKey,
+		mitmCA.PrivateKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{
+		Certificate: [][]byte{der, mitmCA.Certificate[0]},
+		PrivateKey:  mitmLeafKey,
+	}
+	if len(mitmHosts) >= maxMITMCerts {
+		delete(mitmCerts, mitmHosts[0])
+		mitmHosts = mitmHosts[1:]
+	}
+	mitmCerts[host] = cert
+	mitmHosts = append(mitmHosts, host)
+	return cert, nil
+}
+
+// connect handles CONNECT requests of clients using dumpproxy as
+// a forward proxy.
+func connect(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		logRequest(
+			r, http.StatusNotImplemented, "", time.Now(), 0,
+			errors.New("connection doesn't support hijacking"),
+		)
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	if mitmCA != nil {
+		intercept(hijacker, r)
+	} else {
+		tunnel(w, hijacker, r)
+	}
+}
+
+// tunnel relays the TCP stream between client and the requested host and
+// dumps raw bytes sent in each direction as request and response bodies.
+// Tunnels are captured like other exchanges, to the dump directory of the
+// route matching them.
+func tunnel(w http.ResponseWriter, hijacker http.Hijacker, r *http.Request) {
+	var (
+		err         error
+		fx          *dumpproxy.FileExchange
+		fNamePrefix string
+		statusCode  = 0
+	)
+
+	ex := &dumpproxy.Exchange{Started: time.Now(), Request: r, UpstreamRequest: r}
+	defer func() {
+		logRequest(r, statusCode, fNamePrefix, ex.Started, 0, err)
+	}()
+
+	// The response is known upfront, excluded tunnels are never dumped.
+	established := &http.Response{
+		Status:     "200 Connection established",
+		StatusCode: http.StatusOK,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	rules := currentRules()
+	if rules.capture.captureRequest(r) &&
+		rules.capture.captureResponse(r, established) {
+		fx, err = fileSink(rules.findRoute(r).Dir, rules.redaction).Open(ex)
+		if err != nil {
+			statusCode = http.StatusInternalServerError
+			w.WriteHeader(statusCode)
+			return
+		}
+		fNamePrefix = fx.Prefix
+		trackDump(fNamePrefix)
+	}
+	// Runs before logging, the exchange is recorded by then.
+	defer func() {
+		if fx == nil {
+			return
+		}
+		ex.StatusCode = statusCode
+		ex.Err = err
+		closeErr := fx.Close(ex)
+		if err == nil && closeErr == nil {
+			recordMeta(fNamePrefix, r, r.Host, statusCode, ex.Started, nil)
+		}
+		untrackDump(fNamePrefix)
+	}()
+
+	var upstream net.Conn
+	upstream, err = dialer.DialContext(r.Context(), "tcp", r.Host)
+	if err != nil {
+		upstreamErrorsTotal.add("", 1)
+		statusCode = http.StatusBadGateway
+		w.WriteHeader(statusCode)
+		return
+	}
+	defer closeLogError(upstream)
+
+	ex.Response = established
+	reqBody, respBody := ioutil.Discard, ioutil.Discard
+	if fx != nil {
+		reqBody = fx.RequestBody()
+		respBody, err = fx.WriteResponse(ex.Response)
+		if err != nil {
+			statusCode = http.StatusInternalServerError
+			w.WriteHeader(statusCode)
+			return
+		}
+	}
+
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		statusCode = http.StatusInternalServerError
+		w.WriteHeader(statusCode)
+		return
+	}
+	defer closeLogError(client)
+	trackTunnel(nil)
+	defer untrackTunnel(nil)
+
+	statusCode = http.StatusOK
+	_, err = io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		// Client may have sent data before getting our response, it sits
+		// in the buffered reader.
+		_, err := io.Copy(io.MultiWriter(upstream, reqBody), buf.Reader)
+		logTunnelError(err)
+		closeWrite(upstream)
+		close(done)
+	}()
+	_, copyErr := io.Copy(io.MultiWriter(client, respBody), upstream)
+	logTunnelError(copyErr)
+	closeWrite(client)
+	<-done
+}
+
+// intercept terminates TLS of the CONNECT tunnel with a certificate
+// signed by the MITM CA and proxies decrypted requests to the requested
+// host, dumping them as usual.
+func intercept(hijacker http.Hijacker, r *http.Request) {
+	started := time.Now()
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		logRequest(r, 0, "", started, 0, err)
+		return
+	}
+	// Client may have sent the TLS handshake before getting our response,
+	// it sits in the buffered reader.
+	client := &bufferedConn{Conn: conn, r: buf.Reader}
+
+	_, err = io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		logRequest(r, http.StatusOK, "", started, 0, err)
+		closeLogError(client)
+		return
+	}
+	logRequest(r, http.StatusOK, "", started, 0, nil)
+
+	connectHost, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		connectHost = r.Host
+	}
+	tlsConn := tls.Server(client, &tls.Config{
+		GetCertificate: func(
+			hello *tls.ClientHelloInfo,
+		) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return mitmCertificate(hello.ServerName)
+			}
+			return mitmCertificate(connectHost)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+
+	srv := &http.Server{
+		Handler: withRequestID(http.HandlerFunc(
+			func(w http.ResponseWriter, ir *http.Request) {
+				ir.URL.Scheme = "https"
+				ir.URL.Host = ir.Host
+				if ir.URL.Host == "" {
+					ir.URL.Host = r.Host
+				}
+				serveExchange(w, ir, true)
+			},
+		)),
+	}
+	trackTunnel(srv)
+	defer untrackTunnel(srv)
+	// Serve returns once the tunneled connection is closed.
+	_ = srv.Serve(newSingleConnListener(tlsConn))
+}
+
+// bufferedConn reads what was buffered from the connection before
+// reading the connection itself.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func closeWrite(conn io.Closer) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		// Fails if the peer is already gone, nothing to do about it.
+		_ = cw.CloseWrite()
+		return
+	}
+	closeLogError(conn)
+}
+
+func logTunnelError(err error) {
+	if err != nil {
+		log.Printf("tunnel: %v", err)
+	}
+}
+
+// singleConnListener hands out one connection and blocks further Accept
+// calls until that connection is closed.
+type singleConnListener struct {
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{done: make(chan struct{})}
+	l.conn = &notifyCloseConn{Conn: conn, closed: l.close}
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	if l.conn != nil {
+		conn := l.conn
+		l.conn = nil
+		return conn, nil
+	}
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *singleConnListener) Close() error {
+	l.close()
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return dummyAddr{}
+}
+
+func (l *singleConnListener) close() {
+	l.once.Do(func() { close(l.done) })
+}
+
+type notifyCloseConn struct {
+	net.Conn
+	closed func()
+}
+
+func (c *notifyCloseConn) Close() error {
+	err := c.Conn.Close()
+	c.closed()
+	return err
+}
+
+type dummyAddr struct{}
+
+func (dummyAddr) Network() string { return "tunnel" }
+func (dummyAddr) String() string  { return "tunnel" }
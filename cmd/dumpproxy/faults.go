@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olomix/dumpproxy"
+)
+
+var injectLatency latencyRange
+var injectErrorRate = flag.Float64(
+	"inject-error-rate", 0,
+	"fraction of requests answered with -inject-error-status without "+
+		"calling the upstream",
+)
+var injectErrorStatus = flag.String(
+	"inject-error-status", "502,503",
+	"comma separated status codes of injected errors, picked at random",
+)
+var abortRate = flag.Float64(
+	"abort-rate", 0,
+	"fraction of responses cut off mid-body by closing the connection",
+)
+var bandwidthLimit byteSize
+
+func init() {
+	flag.Var(
+		&injectLatency, "inject-latency",
+		"delay requests before sending them upstream, e.g. 200ms or "+
+			"200ms±100ms",
+	)
+	flag.Var(
+		&bandwidthLimit, "bandwidth-limit",
+		"stream responses at most this many bytes per second, e.g. 64K",
+	)
+}
+
+var injectErrorCodes []int
+
+// errInjectedAbort stops streaming of a response chosen by -abort-rate.
+var errInjectedAbort = fmt.Errorf(
+	"injected abort: %w", dumpproxy.ErrAbortResponse,
+)
+
+// latencyRange is a flag value of a duration with optional uniformly
+// distributed jitter: 200ms±100ms or 200ms+-100ms.
+type latencyRange struct {
+	base, jitter time.Duration
+}
+
+func (lr *latencyRange) String() string {
+	if lr.jitter == 0 {
+		return lr.base.String()
+	}
+	return lr.base.String() + "±" + lr.jitter.String()
+}
+
+func (lr *latencyRange) Set(value string) error {
+	parts := strings.SplitN(strings.Replace(value, "+-", "±", 1), "±", 2)
+	base, err := time.ParseDuration(parts[0])
+	if err != nil {
+		return err
+	}
+	var jitter time.Duration
+	if len(parts) == 2 {
+		if jitter, err = time.ParseDuration(parts[1]); err != nil {
+			return err
+		}
+	}
+	if base < 0 || jitter < 0 {
+		return fmt.Errorf("negative latency %v", value)
+	}
+	lr.base, lr.jitter = base, jitter
+	return nil
+}
+
+func (lr *latencyRange) pick() time.Duration {
+	if lr.jitter == 0 {
+		return lr.base
+	}
+	d := lr.base - lr.jitter +
+		time.Duration(rand.Int63n(int64(2*lr.jitter)+1))
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// parseFaultFlags validates fault injection flags.
+func parseFaultFlags() error {
+	for _, rate := range []float64{*injectErrorRate, *abortRate} {
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("fault rate %v is out of [0, 1]", rate)
+		}
+	}
+	injectErrorCodes = nil
+	for _, code := range strings.Split(*injectErrorStatus, ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(code))
+		if err != nil || n < 100 || n > 599 {
+			return fmt.Errorf("invalid -inject-error-status %v", code)
+		}
+		injectErrorCodes = append(injectErrorCodes, n)
+	}
+	return nil
+}
+
+// faultPlan is the set of faults injected into an exchange.
+type faultPlan struct {
+	latency     time.Duration
+	errorStatus int
+	abort       bool
+	bandwidth   int64
+	// aborted is set once a planned abort cut the response off after sent
+	// bytes of the body.
+	aborted bool
+	sent    int64
+}
+
+func planFaults() *faultPlan {
+	fp := &faultPlan{
+		latency:   injectLatency.pick(),
+		bandwidth: int64(bandwidthLimit),
+	}
+	if *injectErrorRate > 0 && rand.Float64() < *injectErrorRate {
+		fp.errorStatus = injectErrorCodes[rand.Intn(len(injectErrorCodes))]
+	}
+	if *abortRate > 0 && rand.Float64() < *abortRate {
+		fp.abort = true
+	}
+	return fp
+}
+
+// describe lists injected faults as recorded in the exchange metadata.
+func (fp *faultPlan) describe() []string {
+	var faults []string
+	if fp.latency > 0 {
+		faults = append(faults, "latency "+fp.latency.String())
+	}
+	if fp.errorStatus != 0 {
+		faults = append(faults, fmt.Sprintf("error %v", fp.errorStatus))
+	}
+	if fp.aborted {
+		faults = append(faults, fmt.Sprintf("abort after %v bytes", fp.sent))
+	}
+	if fp.bandwidth > 0 {
+		faults = append(faults, fmt.Sprintf("bandwidth %v B/s", fp.bandwidth))
+	}
+	return faults
+}
+
+// faultedResponse tells if faults described in metadata made up the
+// response or cut it off, so the dump isn't what the upstream sent.
+func faultedResponse(faults []string) bool {
+	for _, fault := range faults {
+		if strings.HasPrefix(fault, "error ") ||
+			strings.HasPrefix(fault, "abort ") {
+			return true
+		}
+	}
+	return false
+}
+
+// delay waits for the injected latency unless the client goes away.
+func (fp *faultPlan) delay(r *http.Request) error {
+	if fp.latency == 0 {
+		return nil
+	}
+	timer := time.NewTimer(fp.latency)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+}
+
+// injectedResponse stands in for the upstream response of an injected
+// error.
+func (fp *faultPlan) injectedResponse(r *http.Request) *http.Response {
+	text := http.StatusText(fp.errorStatus) + "\n"
+	header := make(http.Header)
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Content-Length", strconv.Itoa(len(text)))
+	return &http.Response{
+		Status: fmt.Sprintf(
+			"%v %v", fp.errorStatus, http.StatusText(fp.errorStatus),
+		),
+		StatusCode:    fp.errorStatus,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(text)),
+		ContentLength: int64(len(text)),
+		Request:       r,
+	}
+}
+
+// faultTransport delays requests and answers them with injected errors
+// as planned for their exchange.
+type faultTransport struct {
+	next http.RoundTripper
+}
+
+func (ft faultTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	fp := exchangeOf(r.Context()).faults
+	if err := fp.delay(r); err != nil {
+		closeLogError(r.Body)
+		return nil, err
+	}
+	if fp.errorStatus == 0 {
+		return ft.next.RoundTrip(r)
+	}
+
+	// The upstream is never called, read the body to dump it anyway.
+	_, err := io.Copy(ioutil.Discard, r.Body)
+	closeLogError(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	return fp.injectedResponse(r), nil
+}
+
+// responseWriter wraps w with the planned bandwidth limit and abort.
+func (fp *faultPlan) responseWriter(w http.ResponseWriter) http.ResponseWriter {
+	if fp.bandwidth == 0 && !fp.abort {
+		return w
+	}
+	return &faultWriter{ResponseWriter: w, fp: fp}
+}
+
+// faultWriter applies faults to the response body. Aborts happen halfway
+// through the body or after the first write if the length is unknown.
+type faultWriter struct {
+	http.ResponseWriter
+	fp   *faultPlan
+	body io.Writer
+}
+
+func (fw *faultWriter) Write(p []byte) (int, error) {
+	if fw.body == nil {
+		fw.body = fw.ResponseWriter
+		if fw.fp.bandwidth > 0 {
+			fw.body = &throttledWriter{
+				w: fw.ResponseWriter, rate: fw.fp.bandwidth, started: time.Now(),
+			}
+		}
+		if fw.fp.abort {
+			contentLength, err := strconv.ParseInt(
+				fw.Header().Get("Content-Length"), 10, 64,
+			)
+			if err != nil {
+				contentLength = -1
+			}
+			fw.body = &abortingWriter{
+				w: fw.body, fp: fw.fp, limit: contentLength / 2,
+			}
+		}
+	}
+	return fw.body.Write(p)
+}
+
+func (fw *faultWriter) Flush() {
+	if f, ok := fw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (fw *faultWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := fw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection doesn't support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// throttledWriter flushes writes to the client no faster than rate bytes
+// per second.
+type throttledWriter struct {
+	w       http.ResponseWriter
+	rate    int64
+	started time.Time
+	written int64
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	n := 0
+	// Small chunks keep the stream smooth.
+	chunk := int(tw.rate/10) + 1
+	for n < len(p) {
+		end := n + chunk
+		if end > len(p) {
+			end = len(p)
+		}
+		m, err := tw.w.Write(p[n:end])
+		n += m
+		tw.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		if f, ok := tw.w.(http.Flusher); ok {
+			f.Flush()
+		}
+		due := time.Duration(
+			float64(tw.written) / float64(tw.rate) * float64(time.Second),
+		)
+		time.Sleep(due - time.Since(tw.started))
+	}
+	return n, nil
+}
+
+// Flush is a no-op, every write is flushed already.
+func (tw *throttledWriter) Flush() {}
+
+// abortingWriter passes limit bytes of the body and fails the next
+// write.
+type abortingWriter struct {
+	w     io.Writer
+	fp    *faultPlan
+	limit int64
+}
+
+func (aw *abortingWriter) Write(p []byte) (int, error) {
+	if aw.fp.aborted {
+		return 0, errInjectedAbort
+	}
+	if aw.limit <= 0 {
+		if aw.fp.sent > 0 {
+			return 0, aw.abort()
+		}
+		n, err := aw.w.Write(p)
+		aw.fp.sent += int64(n)
+		return n, err
+	}
+
+	rest := aw.limit - aw.fp.sent
+	if int64(len(p)) < rest {
+		n, err := aw.w.Write(p)
+		aw.fp.sent += int64(n)
+		return n, err
+	}
+	n, err := aw.w.Write(p[:rest])
+	aw.fp.sent += int64(n)
+	if err != nil {
+		return n, err
+	}
+	return n, aw.abort()
+}
+
+// abort flushes what the client got so far, the connection is closed
+// without flushing once the exchange ends.
+func (aw *abortingWriter) abort() error {
+	aw.Flush()
+	aw.fp.aborted = true
+	return errInjectedAbort
+}
+
+func (aw *abortingWriter) Flush() {
+	if f, ok := aw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// abortedDump writes the response body dump one write behind the client,
+// so the dump of an aborted response ends where the client's copy does.
+type abortedDump struct {
+	w       io.Writer
+	fp      *faultPlan
+	pending []byte
+	dumped  int64
+}
+
+func (ad *abortedDump) Write(p []byte) (int, error) {
+	if err := ad.flush(); err != nil {
+		return 0, err
+	}
+	ad.pending = append(ad.pending, p...)
+	return len(p), nil
+}
+
+// flush dumps the pending write, cut to the bytes sent to the client if
+// the response was aborted.
+func (ad *abortedDump) flush() error {
+	p := ad.pending
+	ad.pending = ad.pending[:0]
+	if ad.fp.aborted && ad.dumped+int64(len(p)) > ad.fp.sent {
+		p = p[:0]
+		if ad.fp.sent > ad.dumped {
+			p = ad.pending[:ad.fp.sent-ad.dumped]
+		}
+	}
+	n, err := ad.w.Write(p)
+	ad.dumped += int64(n)
+	return err
+}
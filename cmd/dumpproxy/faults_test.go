@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyRangeSet(t *testing.T) {
+	testCases := []struct {
+		in           string
+		base, jitter time.Duration
+		wantErr      bool
+	}{
+		{in: "200ms", base: 200 * time.Millisecond},
+		{
+			in:   "200ms±100ms",
+			base: 200 * time.Millisecond, jitter: 100 * time.Millisecond,
+		},
+		{in: "1s+-1ms", base: time.Second, jitter: time.Millisecond},
+		{in: "-1s", wantErr: true},
+		{in: "1s±-1s", wantErr: true},
+		{in: "1s±", wantErr: true},
+		{in: "fast", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			var lr latencyRange
+			err := lr.Set(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Set(%q) error = %v", tc.in, err)
+			}
+			if lr.base != tc.base || lr.jitter != tc.jitter {
+				t.Errorf("got %v±%v, want %v±%v",
+					lr.base, lr.jitter, tc.base, tc.jitter)
+			}
+		})
+	}
+}
+
+func TestLatencyRangePick(t *testing.T) {
+	lr := latencyRange{
+		base: 10 * time.Millisecond, jitter: 20 * time.Millisecond,
+	}
+	for i := 0; i < 1000; i++ {
+		if d := lr.pick(); d < 0 || d > 30*time.Millisecond {
+			t.Fatalf("picked %v out of range", d)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"mime"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var sampleRate = flag.Float64(
+	"sample-rate", 1, "fraction of matching exchanges to dump, from 0 to 1",
+)
+
+// captureRules select exchanges to dump, others are proxied without
+// touching the disk. An exchange is dumped if it matches any of Include
+// rules (or Include is empty) and none of Exclude rules.
+type captureRules struct {
+	Include []*captureRule `json:"include,omitempty"`
+	Exclude []*captureRule `json:"exclude,omitempty"`
+
+	// checksResponse is set if any rule has response fields, so
+	// captureResponse may drop exchanges selected by captureRequest.
+	checksResponse bool
+}
+
+// captureRule matches exchanges having all of the set fields. Path is
+// a regular expression, Status is a code like 404 or a class like 5xx,
+// ContentType is the response media type.
+type captureRule struct {
+	Method      string `json:"method,omitempty"`
+	Host        string `json:"host,omitempty"`
+	Path        string `json:"path,omitempty"`
+	Status      string `json:"status,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+
+	pathRe *regexp.Regexp
+}
+
+var capture = &captureRules{}
+
+func (cr *captureRules) compile() error {
+	for _, rule := range append(cr.Include, cr.Exclude...) {
+		if rule.Path != "" {
+			var err error
+			if rule.pathRe, err = regexp.Compile(rule.Path); err != nil {
+				return err
+			}
+		}
+		if rule.Status != "" && !validStatusPattern(rule.Status) {
+			return fmt.Errorf("invalid status %v", rule.Status)
+		}
+		if rule.hasResponseFields() {
+			cr.checksResponse = true
+		}
+	}
+	return nil
+}
+
+func validStatusPattern(status string) bool {
+	if len(status) != 3 {
+		return false
+	}
+	if strings.HasSuffix(status, "xx") {
+		return status[0] >= '1' && status[0] <= '5'
+	}
+	_, err := strconv.Atoi(status)
+	return err == nil
+}
+
+// matchStatus reports whether statusCode matches a status pattern checked
+// by validStatusPattern.
+func matchStatus(pattern string, statusCode int) bool {
+	code := strconv.Itoa(statusCode)
+	if strings.HasSuffix(pattern, "xx") {
+		return code[0] == pattern[0]
+	}
+	return code == pattern
+}
+
+func (rule *captureRule) hasResponseFields() bool {
+	return rule.Status != "" || rule.ContentType != ""
+}
+
+func (rule *captureRule) matchRequest(r *http.Request) bool {
+	if rule.Method != "" && !strings.EqualFold(rule.Method, r.Method) {
+		return false
+	}
+	if rule.Host != "" && !strings.EqualFold(rule.Host, r.Host) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil || !strings.EqualFold(rule.Host, host) {
+			return false
+		}
+	}
+	if rule.pathRe != nil && !rule.pathRe.MatchString(r.URL.Path) {
+		return false
+	}
+	return true
+}
+
+func (rule *captureRule) match(r *http.Request, resp *http.Response) bool {
+	if !rule.matchRequest(r) {
+		return false
+	}
+	if rule.Status != "" && !matchStatus(rule.Status, resp.StatusCode) {
+		return false
+	}
+	if rule.ContentType != "" {
+		mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		if !strings.EqualFold(mediaType, rule.ContentType) {
+			return false
+		}
+	}
+	return true
+}
+
+// captureRequest decides whether to dump the exchange before it's sent
+// upstream. Rules on response fields can't be checked yet and are
+// assumed to match, captureResponse makes the final decision.
+func (cr *captureRules) captureRequest(r *http.Request) bool {
+	if *sampleRate < 1 && rand.Float64() >= *sampleRate {
+		return false
+	}
+
+	if len(cr.Include) > 0 {
+		included := false
+		for _, rule := range cr.Include {
+			if rule.matchRequest(r) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, rule := range cr.Exclude {
+		if !rule.hasResponseFields() && rule.matchRequest(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// captureResponse decides whether to keep the dump of the exchange once
+// the upstream responded.
+func (cr *captureRules) captureResponse(
+	r *http.Request,
+	resp *http.Response,
+) bool {
+	if len(cr.Include) > 0 {
+		included := false
+		for _, rule := range cr.Include {
+			if rule.match(r, resp) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, rule := range cr.Exclude {
+		if rule.match(r, resp) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestMatchStatus(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		valid   bool
+		matches []int
+		misses  []int
+	}{
+		{pattern: "404", valid: true, matches: []int{404}, misses: []int{400}},
+		{
+			pattern: "5xx", valid: true,
+			matches: []int{500, 503, 599}, misses: []int{404, 200},
+		},
+		{pattern: "1xx", valid: true, matches: []int{101}, misses: []int{200}},
+		{pattern: "6xx"},
+		{pattern: "4x"},
+		{pattern: "4044"},
+		{pattern: "abc"},
+		{pattern: ""},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			if got := validStatusPattern(tc.pattern); got != tc.valid {
+				t.Fatalf("validStatusPattern(%q) = %v", tc.pattern, got)
+			}
+			for _, code := range tc.matches {
+				if !matchStatus(tc.pattern, code) {
+					t.Errorf("%v doesn't match %v", code, tc.pattern)
+				}
+			}
+			for _, code := range tc.misses {
+				if matchStatus(tc.pattern, code) {
+					t.Errorf("%v matches %v", code, tc.pattern)
+				}
+			}
+		})
+	}
+}
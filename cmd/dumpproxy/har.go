@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+var harFileName = flag.String(
+	"har-file", "", "also write exchanges as HAR 1.2 entries to this file",
+)
+var harFlushInterval = flag.Duration(
+	"har-flush-interval", 5*time.Second, "how often to flush the HAR file",
+)
+var harMaxBodySize = byteSize(1024 * 1024)
+
+func init() {
+	flag.Var(
+		&harMaxBodySize, "har-max-body-size",
+		"leave bodies larger than this out of HAR entries, e.g. 512K",
+	)
+}
+
+// harDump is the HAR file entries are flushed to. The file is valid HAR
+// after every flush: new entries overwrite the closing brackets which are
+// then written again.
+type harDump struct {
+	mu         sync.Mutex
+	f          *os.File
+	pending    [][]byte
+	entries    int
+	tailOffset int64
+}
+
+var har *harDump
+
+const harHead = `{"log":{"version":"1.2",` +
+	`"creator":{"name":"dumpproxy","version":"1"},"entries":[`
+const harTail = "\n]}}\n"
+
+func openHAR(fName string) (*harDump, error) {
+	f, err := os.Create(fName)
+	if err != nil {
+		return nil, err
+	}
+	h := &harDump{f: f, tailOffset: int64(len(harHead))}
+	if _, err = f.WriteString(harHead + harTail); err != nil {
+		closeLogError(f)
+		return nil, err
+	}
+	return h, nil
+}
+
+func (h *harDump) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := h.flush(); err != nil {
+			log.Printf("har: %v", err)
+		}
+	}
+}
+
+func (h *harDump) add(entry *harEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("har: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	h.pending = append(h.pending, data)
+	h.mu.Unlock()
+}
+
+func (h *harDump) flush() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.pending) == 0 {
+		return nil
+	}
+
+	if _, err := h.f.Seek(h.tailOffset, 0); err != nil {
+		return err
+	}
+	for _, data := range h.pending {
+		sep := ",\n"
+		if h.entries == 0 {
+			sep = "\n"
+		}
+		n, err := h.f.WriteString(sep)
+		if err != nil {
+			return err
+		}
+		h.tailOffset += int64(n)
+		n, err = h.f.Write(data)
+		if err != nil {
+			return err
+		}
+		h.tailOffset += int64(n)
+		h.entries++
+	}
+	h.pending = nil
+
+	if _, err := h.f.WriteString(harTail); err != nil {
+		return err
+	}
+	return h.f.Sync()
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []harNameValue `json:"params"`
+	Text     string         `json:"text"`
+	Encoding string         `json:"encoding,omitempty"`
+	Comment  string         `json:"comment,omitempty"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+// newHAREntry builds a HAR entry of a completed exchange, bodies are read
+// back from the dump files and headers are redacted with rr.
+func newHAREntry(
+	fNamePrefix string,
+	rr *redactRules,
+	r *http.Request,
+	reqURL string,
+	resp *http.Response,
+	started, respStarted, finished time.Time,
+) (*harEntry, error) {
+	reqBody, reqBodySize, err := readHARBody(fNamePrefix + suffixReqBody)
+	if err != nil {
+		return nil, err
+	}
+	respBody, respBodySize, err := readHARBody(fNamePrefix + suffixRespBody)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &harEntry{
+		StartedDateTime: started.Format(time.RFC3339Nano),
+		Time:            milliseconds(finished.Sub(started)),
+		Request: harRequest{
+			Method:      r.Method,
+			URL:         reqURL,
+			HTTPVersion: r.Proto,
+			Cookies:     harCookies(r.Cookies(), "Cookie", rr),
+			Headers:     harHeaders(r.Header, rr),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    reqBodySize,
+		},
+		Response: harResponse{
+			Status:      resp.StatusCode,
+			StatusText:  http.StatusText(resp.StatusCode),
+			HTTPVersion: resp.Proto,
+			Cookies:     harCookies(resp.Cookies(), "Set-Cookie", rr),
+			Headers:     harHeaders(resp.Header, rr),
+			Content: harContent{
+				Size:     respBodySize,
+				MimeType: resp.Header.Get("Content-Type"),
+			},
+			RedirectURL: resp.Header.Get("Location"),
+			HeadersSize: -1,
+			BodySize:    resp.ContentLength,
+		},
+		Timings: harTimings{
+			Wait:    milliseconds(respStarted.Sub(started)),
+			Receive: milliseconds(finished.Sub(respStarted)),
+		},
+		Comment: exchangeID(fNamePrefix),
+	}
+	if entry.Response.Content.MimeType == "" {
+		entry.Response.Content.MimeType = "application/octet-stream"
+	}
+	if respBody != nil {
+		entry.Response.Content.Text, entry.Response.Content.Encoding =
+			harText(respBody, entry.Response.Content.MimeType)
+	} else {
+		entry.Response.Content.Comment = harBodyOmitted(respBodySize)
+	}
+
+	query, _ := url.ParseQuery(rr.RedactQuery(r.URL.RawQuery))
+	for name, values := range query {
+		for _, value := range values {
+			entry.Request.QueryString = append(
+				entry.Request.QueryString, harNameValue{name, value},
+			)
+		}
+	}
+
+	if reqBodySize > 0 {
+		postData := &harPostData{
+			MimeType: r.Header.Get("Content-Type"),
+			Params:   []harNameValue{},
+		}
+		if reqBody != nil {
+			postData.Text, postData.Encoding =
+				harText(reqBody, postData.MimeType)
+		} else {
+			postData.Comment = harBodyOmitted(reqBodySize)
+		}
+		entry.Request.PostData = postData
+	}
+
+	return entry, nil
+}
+
+// readHARBody reads a body dump and its size. Bodies larger than
+// -har-max-body-size are not read, so the body is nil.
+func readHARBody(fName string) ([]byte, int64, error) {
+	fi, err := os.Stat(fName)
+	if err != nil {
+		return nil, 0, err
+	}
+	if fi.Size() > int64(harMaxBodySize) {
+		return nil, fi.Size(), nil
+	}
+	body, err := ioutil.ReadFile(fName)
+	return body, int64(len(body)), err
+}
+
+func harBodyOmitted(size int64) string {
+	return fmt.Sprintf(
+		"body of %v bytes omitted, it's larger than -har-max-body-size", size,
+	)
+}
+
+// harText returns body as HAR text, base64 encoded unless it's readable
+// text.
+func harText(body []byte, mimeType string) (string, string) {
+	if len(body) == 0 {
+		return "", ""
+	}
+	if utf8.Valid(body) && isTextual(mimeType) {
+		return string(body), ""
+	}
+	return base64.StdEncoding.EncodeToString(body), "base64"
+}
+
+func isTextual(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		// Unknown type, utf8 check is the best guess we have.
+		return true
+	}
+	switch mediaType {
+	case "application/octet-stream", "application/zip", "application/pdf",
+		"application/gzip":
+		return false
+	}
+	for _, prefix := range []string{"image/", "audio/", "video/", "font/"} {
+		if strings.HasPrefix(mediaType, prefix) {
+			return mediaType == "image/svg+xml"
+		}
+	}
+	return true
+}
+
+func harHeaders(header http.Header, rr *redactRules) []harNameValue {
+	headers := []harNameValue{}
+	for name, values := range header {
+		for _, value := range values {
+			headers = append(
+				headers, harNameValue{name, rr.RedactHeader(name, value)},
+			)
+		}
+	}
+	return headers
+}
+
+func harCookies(
+	cookies []*http.Cookie,
+	header string,
+	rr *redactRules,
+) []harNameValue {
+	result := []harNameValue{}
+	for _, cookie := range cookies {
+		result = append(
+			result,
+			harNameValue{cookie.Name, rr.RedactHeader(header, cookie.Value)},
+		)
+	}
+	return result
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olomix/dumpproxy"
+)
+
+var listenAddr = flag.String("listen-addr", "localhost:8080", "listen address")
+var upstreamAddr = flag.String(
+	"upstream-addr", "localhost:80", "upstream address",
+)
+var upstreamScheme = flag.String(
+	"upstream-scheme", "http", "upstream scheme, http or https",
+)
+var upstreamTLSSkipVerify = flag.Bool(
+	"upstream-tls-skip-verify", false,
+	"don't verify upstream TLS certificate",
+)
+var upstreamTLSServerName = flag.String(
+	"upstream-tls-server-name", "",
+	"server name sent to the TLS upstream of -upstream-addr and checked in "+
+		"its certificate (default host of the upstream address)",
+)
+var tlsCert = flag.String(
+	"tls-cert", "", "certificate file to serve TLS on the listen address",
+)
+var tlsKey = flag.String("tls-key", "", "private key file for -tls-cert")
+var dumpDir = flag.String("dir", "./", "directory to dump traffic")
+var identityEncoding = flag.Bool(
+	"identity-encoding", false,
+	"override Accept-Encoding with identity so upstream responses are "+
+		"dumped uncompressed",
+)
+
+var decodeDumps = flag.Bool(
+	"decode-dumps", true,
+	"decode compressed response bodies in dumps, clients always get them "+
+		"as sent by upstream",
+)
+
+const suffixReqHeaders = dumpproxy.SuffixRequestHeaders
+const suffixReqBody = dumpproxy.SuffixRequestBody
+const suffixRespHeaders = dumpproxy.SuffixResponseHeaders
+const suffixRespBody = dumpproxy.SuffixResponseBody
+const suffixWSFrames = dumpproxy.SuffixWSFrames
+
+var dumpSuffixes = []string{
+	suffixReqHeaders, suffixReqBody, suffixRespHeaders, suffixRespBody,
+}
+
+// optionalDumpSuffixes are dump files only some exchanges have.
+var optionalDumpSuffixes = []string{suffixWSFrames}
+
+func allDumpSuffixes() []string {
+	suffixes := make([]string, 0, len(dumpSuffixes)+len(optionalDumpSuffixes))
+	suffixes = append(suffixes, dumpSuffixes...)
+	return append(suffixes, optionalDumpSuffixes...)
+}
+
+var dialer = &net.Dialer{
+	Timeout:   30 * time.Second,
+	KeepAlive: 30 * time.Second,
+	DualStack: true,
+}
+
+var upstreamTLSConfig = &tls.Config{}
+
+// upstreamTransport sends requests to upstreams. Request URLs point to
+// the upstream address, so TLS server names come from it, never from the
+// Host header. Routes setting TLSServerName get clones of it.
+var upstreamTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           dialer.DialContext,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+	TLSClientConfig:       upstreamTLSConfig,
+	// Pass compressed bodies to the client untouched, dumps are decoded
+	// separately.
+	DisableCompression: true,
+}
+
+// directTransport is used when dumpproxy acts as a forward proxy and
+// connects to the host requested by the client instead of the upstream.
+var directTransport = &http.Transport{
+	Proxy:                 http.ProxyFromEnvironment,
+	DialContext:           dialer.DialContext,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+	DisableCompression:    true,
+}
+
+// serverNameTransports are upstreamTransport clones sending other TLS
+// server names, by server name. Each has its own connection pool, so
+// connections are never reused with another server name.
+var serverNameTransports = struct {
+	sync.Mutex
+	byName map[string]*http.Transport
+}{byName: make(map[string]*http.Transport)}
+
+// routeTransport returns the transport sending requests to the upstream
+// of rt.
+func routeTransport(rt *route) *http.Transport {
+	if rt.TLSServerName == "" {
+		return upstreamTransport
+	}
+	serverNameTransports.Lock()
+	defer serverNameTransports.Unlock()
+	t, ok := serverNameTransports.byName[rt.TLSServerName]
+	if !ok {
+		t = upstreamTransport.Clone()
+		t.TLSClientConfig.ServerName = rt.TLSServerName
+		serverNameTransports.byName[rt.TLSServerName] = t
+	}
+	return t
+}
+
+// exchangeTransport sends requests of routed exchanges with
+// upstreamTransport and forward proxy ones with directTransport.
+type exchangeTransport struct{}
+
+func (exchangeTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	state := exchangeOf(r.Context())
+	if state.forward {
+		return directTransport.RoundTrip(r)
+	}
+	return routeTransport(state.route).RoundTrip(r)
+}
+
+var upstreamProxy = &dumpproxy.Proxy{
+	Upstream:  dumpproxy.ResolverFunc(resolveUpstream),
+	Sink:      dumpSink{},
+	Transport: faultTransport{meteredTransport{exchangeTransport{}}},
+	Finished:  logExchange,
+	Context:   upstreamCtx,
+}
+
+// exchange is the state of a proxied exchange shared by the handler, the
+// resolver, the sink and the transport through the request context.
+type exchange struct {
+	// rules are the ones in effect when the exchange started.
+	rules *ruleSet
+	// route matches the request, it picks the dump directory and, unless
+	// forward is set, the upstream.
+	route *route
+	// forward is set if dumpproxy is used as a forward proxy and goes to
+	// the requested host.
+	forward bool
+	faults  *faultPlan
+	// prefix is set once the exchange is dumped.
+	prefix string
+}
+
+type exchangeKey struct{}
+
+// exchangeOf returns the state of the exchange ctx belongs to. Exchanges
+// that didn't come through proxy get the default one.
+func exchangeOf(ctx context.Context) *exchange {
+	if ex, ok := ctx.Value(exchangeKey{}).(*exchange); ok {
+		return ex
+	}
+	return &exchange{rules: currentRules(), faults: &faultPlan{}}
+}
+
+// dir returns the directory the exchange is dumped to.
+func (ex *exchange) dir() string {
+	if ex.route == nil {
+		return *dumpDir
+	}
+	return ex.route.Dir
+}
+
+func proxy(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodConnect && !*forwardProxy:
+		logRequest(
+			r, http.StatusMethodNotAllowed, "", time.Now(), 0,
+			errors.New("CONNECT needs -forward-proxy"),
+		)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	case r.Method == http.MethodConnect:
+		connect(w, r)
+	case r.URL.IsAbs() && *forwardProxy:
+		// dumpproxy is used as a forward proxy, go to the requested host
+		// instead of the upstream.
+		serveExchange(w, r, true)
+	default:
+		serveExchange(w, r, false)
+	}
+}
+
+// serveExchange proxies the request to the upstream of the route matching
+// it or to the requested host if forward is set.
+func serveExchange(w http.ResponseWriter, r *http.Request, forward bool) {
+	rules := currentRules()
+	ex := &exchange{
+		rules:   rules,
+		route:   rules.findRoute(r),
+		forward: forward,
+		faults:  planFaults(),
+	}
+	if *identityEncoding {
+		r.Header.Set("Accept-Encoding", "identity")
+	}
+	upstreamProxy.ServeHTTP(
+		ex.faults.responseWriter(w),
+		r.WithContext(context.WithValue(r.Context(), exchangeKey{}, ex)),
+	)
+	if ex.faults.aborted {
+		// Closes the client connection without finishing the response.
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func resolveUpstream(r *http.Request) (*url.URL, error) {
+	state := exchangeOf(r.Context())
+	if state.forward {
+		return r.URL, nil
+	}
+	return &url.URL{Scheme: state.route.Scheme, Host: state.route.Upstream}, nil
+}
+
+// logExchange logs an exchange handled by upstreamProxy.
+func logExchange(ex *dumpproxy.Exchange) {
+	state := exchangeOf(ex.Request.Context())
+	err := ex.Err
+	if err == nil {
+		err = ex.ClientErr
+	}
+	if err == errInjectedAbort {
+		err = nil
+	}
+	var upstreamTime time.Duration
+	if !ex.ResponseStarted.IsZero() {
+		upstreamTime = ex.ResponseStarted.Sub(ex.Started)
+	}
+	logRequest(
+		ex.Request, ex.StatusCode, state.prefix, ex.Started, upstreamTime, err,
+	)
+}
+
+// exchangeURL returns the URL of the exchange as requested by the client.
+func exchangeURL(ex *dumpproxy.Exchange) string {
+	return ex.UpstreamRequest.URL.Scheme + "://" + ex.Request.Host +
+		ex.Request.URL.RequestURI()
+}
+
+// logRequest logs the handled request and updates metrics. upstreamTime
+// is zero unless the request got upstream response headers.
+func logRequest(
+	r *http.Request,
+	statusCode int,
+	fNamePrefix string,
+	started time.Time,
+	upstreamTime time.Duration,
+	err error,
+) {
+	duration := time.Since(started)
+	requestsTotal.add(statusClass(statusCode), 1)
+	requestDuration.observe(duration)
+	if upstreamTime > 0 {
+		upstreamLatency.observe(upstreamTime)
+	}
+
+	writeAccessLog(r, statusCode, fNamePrefix, duration, upstreamTime, err)
+}
+
+// dumpSink dumps exchanges selected by capture rules to the dump
+// directory of their route and records their metadata.
+type dumpSink struct{}
+
+func (s dumpSink) WriteExchange(
+	ctx context.Context,
+	ex *dumpproxy.Exchange,
+) error {
+	return dumpproxy.StreamExchange(ctx, s, ex)
+}
+
+func (dumpSink) OpenExchange(
+	ctx context.Context,
+	ex *dumpproxy.Exchange,
+) (dumpproxy.ExchangeWriter, error) {
+	state := exchangeOf(ctx)
+	rec := &recorder{state: state, ex: ex}
+	if !state.rules.capture.captureRequest(ex.Request) {
+		return rec, nil
+	}
+	if state.rules.capture.checksResponse {
+		// Nothing is written until the response is checked.
+		rec.pending = true
+		return rec, nil
+	}
+	if err := rec.open(); err != nil {
+		return nil, err
+	}
+	return rec, nil
+}
+
+// fileSink returns the sink dumping exchanges to dir as configured by
+// flags, redacted with rr.
+func fileSink(dir string, rr *redactRules) *dumpproxy.FileSink {
+	return &dumpproxy.FileSink{
+		Dir:        dir,
+		DateDirs:   *dirLayout == dirLayoutDate,
+		Decode:     *decodeDumps,
+		Redactor:   rr,
+		Create:     createDump,
+		Incomplete: discardIncomplete,
+	}
+}
+
+// createDump creates a dump file counted by metrics and synced on
+// shutdown.
+func createDump(fName string) (io.WriteCloser, error) {
+	f, err := os.Create(fName)
+	if err != nil {
+		return nil, err
+	}
+	return meteredWriter{dumpFile{f}}, nil
+}
+
+func discardIncomplete(fNamePrefix string, err error) {
+	dir, id := path.Split(fNamePrefix)
+	discardExchange(dir, id, err.Error())
+}
+
+// maxPendingRequestBody is how much of a request body is kept in memory
+// until capture rules check the response. The dump of a longer request is
+// started before and removed if the response is excluded.
+const maxPendingRequestBody = 1 << 20
+
+// recorder dumps an exchange unless capture rules skip it, uncaptured
+// ones have no fx.
+type recorder struct {
+	state *exchange
+	ex    *dumpproxy.Exchange
+	// mu guards fields below, the request body may still be sent while
+	// the response is handled, e.g. when it's an early 401 or 413.
+	mu sync.Mutex
+	// pending is set while the exchange waits for its response to be
+	// checked by capture rules, its request body is kept in pendingBody.
+	pending     bool
+	pendingBody bytes.Buffer
+	fx          *dumpproxy.FileExchange
+	// abortedDump is the response body dump if an abort is planned.
+	abortedDump *abortedDump
+}
+
+// open starts the dump, the request body buffered so far goes first.
+func (rec *recorder) open() error {
+	sink := fileSink(rec.state.dir(), rec.state.rules.redaction)
+	fx, err := sink.Open(rec.ex)
+	if err != nil {
+		return err
+	}
+	trackDump(fx.Prefix)
+	rec.state.prefix = fx.Prefix
+	rec.fx = fx
+	rec.pending = false
+	_, err = rec.pendingBody.WriteTo(fx.RequestBody())
+	return err
+}
+
+func (rec *recorder) RequestBody() io.Writer {
+	return requestBody{rec}
+}
+
+// requestBody writes the request body to the dump of rec as it stands at
+// the time of the write.
+type requestBody struct {
+	rec *recorder
+}
+
+func (rb requestBody) Write(p []byte) (int, error) {
+	rec := rb.rec
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.pending && rec.pendingBody.Len()+len(p) > maxPendingRequestBody {
+		if err := rec.open(); err != nil {
+			return 0, err
+		}
+	}
+	switch {
+	case rec.pending:
+		return rec.pendingBody.Write(p)
+	case rec.fx != nil:
+		return rec.fx.RequestBody().Write(p)
+	}
+	return len(p), nil
+}
+
+func (rec *recorder) WriteResponse(resp *http.Response) (io.Writer, error) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	capture := rec.state.rules.capture
+	captured := capture.captureResponse(rec.ex.Request, resp)
+	if rec.pending && captured {
+		if err := rec.open(); err != nil {
+			return nil, err
+		}
+	}
+	rec.pending = false
+	rec.pendingBody = bytes.Buffer{}
+	if rec.fx != nil && !captured {
+		rec.fx.Discard()
+		untrackDump(rec.fx.Prefix)
+		rec.fx = nil
+		rec.state.prefix = ""
+	}
+	if rec.fx == nil {
+		return ioutil.Discard, nil
+	}
+	body, err := rec.fx.WriteResponse(resp)
+	if err != nil || !rec.state.faults.abort {
+		return body, err
+	}
+	rec.abortedDump = &abortedDump{w: body, fp: rec.state.faults}
+	return rec.abortedDump, nil
+}
+
+func (rec *recorder) WriteFrame(f *dumpproxy.Frame) error {
+	if rec.fx == nil {
+		return nil
+	}
+	return rec.fx.WriteFrame(f)
+}
+
+// Close finishes dumps and records metadata and HAR entries of completed
+// exchanges.
+func (rec *recorder) Close(ex *dumpproxy.Exchange) error {
+	rec.mu.Lock()
+	if rec.pending && ex.Err != nil {
+		// Failed before the response was checked, the dump is handled
+		// like other incomplete ones.
+		if err := rec.open(); err != nil {
+			log.Print(err)
+		}
+	}
+	rec.pending = false
+	fx := rec.fx
+	// Request body bytes still coming are not dumped anymore.
+	rec.fx = nil
+	rec.mu.Unlock()
+	if fx == nil {
+		return nil
+	}
+	// Runs last, once the exchange is recorded.
+	defer untrackDump(fx.Prefix)
+
+	if rec.abortedDump != nil && ex.Err == nil {
+		if err := rec.abortedDump.flush(); err != nil {
+			failed := *ex
+			failed.Err = err
+			ex = &failed
+		}
+	}
+	if err := fx.Close(ex); err != nil || ex.Err != nil {
+		return err
+	}
+
+	rr := rec.state.rules.redaction
+	u := rr.redactURL(exchangeURL(ex))
+	recordMeta(
+		fx.Prefix, ex.Request, u, ex.StatusCode, ex.Started,
+		rec.state.faults.describe(),
+	)
+	if har != nil {
+		entry, err := newHAREntry(
+			fx.Prefix, rr, ex.Request, u, ex.Response, ex.Started,
+			ex.ResponseStarted, time.Now(),
+		)
+		if err != nil {
+			log.Printf("har: %v", err)
+		} else {
+			har.add(entry)
+		}
+	}
+	return nil
+}
+
+func closeLogError(closer io.Closer) {
+	if closer == nil {
+		return
+	}
+
+	err := closer.Close()
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func extractAddr(addr string) string {
+	idx := strings.IndexRune(addr, ':')
+	if idx > 6 {
+		return addr[:idx]
+	}
+	return addr
+}
+
+var commands = map[string]func(args []string){
+	"annotate": annotateCmd,
+	"tagged":   taggedCmd,
+	"search":   searchCmd,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
+	flag.Parse()
+
+	upstreamTLSConfig.InsecureSkipVerify = *upstreamTLSSkipVerify
+
+	newRoutes, newCapture, newRedaction, err := loadRules()
+	if err != nil {
+		panic(err)
+	}
+	setRules(newRoutes, newCapture, newRedaction)
+	rand.Seed(time.Now().UnixNano())
+
+	if (*mitmCACertFile == "") != (*mitmCAKeyFile == "") {
+		panic("-mitm-ca-cert and -mitm-ca-key must be set together")
+	}
+	if *mitmCACertFile != "" && !*forwardProxy {
+		panic("-mitm-ca-cert needs -forward-proxy")
+	}
+	if *mitmCACertFile != "" {
+		if err := loadMITMCA(*mitmCACertFile, *mitmCAKeyFile); err != nil {
+			panic(err)
+		}
+	}
+
+	if (*tlsCert == "") != (*tlsKey == "") {
+		panic("-tls-cert and -tls-key must be set together")
+	}
+
+	if !validIncompleteAction(*incompleteAction) {
+		panic(fmt.Sprintf("unknown -incomplete action %v", *incompleteAction))
+	}
+	if *sampleRate < 0 || *sampleRate > 1 {
+		panic(fmt.Sprintf("-sample-rate %v is not between 0 and 1", *sampleRate))
+	}
+	if err = parseFaultFlags(); err != nil {
+		panic(err)
+	}
+	if !validLogFormat(*logFormat) {
+		panic(fmt.Sprintf("unknown -log-format %v", *logFormat))
+	}
+	if !validDirLayout(*dirLayout) {
+		panic(fmt.Sprintf("unknown -dir-layout %v", *dirLayout))
+	}
+	if err = manageDirs(routeDirs(newRoutes)); err != nil {
+		panic(err)
+	}
+
+	if *harFileName != "" {
+		har, err = openHAR(*harFileName)
+		if err != nil {
+			panic(err)
+		}
+		go har.run(*harFlushInterval)
+	}
+
+	if *metricsAddr != "" {
+		go runMetrics(*metricsAddr)
+	}
+	if *adminAddr != "" {
+		go runAdmin(*adminAddr, *dumpDir)
+	}
+
+	var handler http.Handler
+	switch *mode {
+	case modeProxy:
+		handler = http.HandlerFunc(proxy)
+	case modeReplay:
+		matchKeys, err := parseMatchKeys(*replayMatch)
+		if err != nil {
+			panic(err)
+		}
+		handler, err = loadReplayer(*dumpDir, matchKeys)
+		if err != nil {
+			panic(err)
+		}
+	default:
+		panic(fmt.Sprintf("unknown -mode %v", *mode))
+	}
+
+	serve(&http.Server{Addr: *listenAddr, Handler: withRequestID(handler)})
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServeExchangeCaptureResponse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	us := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/upload" {
+				// Rejected before the body is read.
+				w.WriteHeader(http.StatusRequestEntityTooLarge)
+				return
+			}
+			_, _ = ioutil.ReadAll(r.Body)
+		},
+	))
+	defer us.Close()
+	upstreamURL, err := url.Parse(us.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := currentRules()
+	defer setRules(old.routes, old.capture, old.redaction)
+	cr := &captureRules{Exclude: []*captureRule{{Status: "413"}}}
+	if err = cr.compile(); err != nil {
+		t.Fatal(err)
+	}
+	setRules(
+		[]*route{{Upstream: upstreamURL.Host, Scheme: "http", Dir: dir}},
+		cr, compiledRules(t, &redactRules{}),
+	)
+	ps := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			serveExchange(w, r, false)
+		},
+	))
+	defer ps.Close()
+
+	testCases := []struct {
+		name     string
+		path     string
+		bodySize int
+		status   int
+		dumps    int
+	}{
+		{"excluded", "/upload", 1000, http.StatusRequestEntityTooLarge, 0},
+		{
+			"excluded large body", "/upload", 2 * maxPendingRequestBody,
+			http.StatusRequestEntityTooLarge, 0,
+		},
+		{"captured", "/echo", 1000, http.StatusOK, 1},
+		{
+			"captured large body", "/echo", 2 * maxPendingRequestBody,
+			http.StatusOK, 2,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte("x"), tc.bodySize)
+			resp, err := http.Post(
+				ps.URL+tc.path, "text/plain", bytes.NewReader(body),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tc.status {
+				t.Errorf("status = %v, want %v", resp.StatusCode, tc.status)
+			}
+
+			dumps, err := filepath.Glob(filepath.Join(dir, "*"+suffixReqBody))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(dumps) != tc.dumps {
+				t.Fatalf("got %v request dumps, want %v", len(dumps), tc.dumps)
+			}
+			if tc.dumps == 0 {
+				return
+			}
+			dumped, err := ioutil.ReadFile(dumps[len(dumps)-1])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dumped, body) {
+				t.Errorf("dumped %v bytes, sent %v", len(dumped), len(body))
+			}
+		})
+	}
+}
+
+func TestRouteTransportServerName(t *testing.T) {
+	serverNames := make(chan string, 1)
+	us := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			serverNames <- r.TLS.ServerName
+		},
+	))
+	defer us.Close()
+	defer func(old bool) {
+		upstreamTLSConfig.InsecureSkipVerify = old
+	}(upstreamTLSConfig.InsecureSkipVerify)
+	upstreamTLSConfig.InsecureSkipVerify = true
+
+	// No server name is sent for IP addresses.
+	for _, want := range []string{"", "auth.example.com", ""} {
+		rt := &route{TLSServerName: want}
+		req, err := http.NewRequest(http.MethodGet, us.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := routeTransport(rt).RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if got := <-serverNames; got != want {
+			t.Errorf("server name = %q, want %q", got, want)
+		}
+	}
+	if upstreamTransport.TLSClientConfig.ServerName != "" {
+		t.Errorf("server name leaked to the shared transport")
+	}
+}
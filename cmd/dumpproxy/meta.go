@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const suffixMeta = ".meta"
+
+// exchangeMeta is stored as JSON next to the dump files of an exchange.
+type exchangeMeta struct {
+	ID           string    `json:"id"`
+	RequestID    string    `json:"request_id,omitempty"`
+	Started      time.Time `json:"started"`
+	DurationMS   float64   `json:"duration_ms"`
+	Method       string    `json:"method,omitempty"`
+	URL          string    `json:"url,omitempty"`
+	Status       int       `json:"status,omitempty"`
+	RequestSize  int64     `json:"request_size"`
+	ResponseSize int64     `json:"response_size"`
+	// Faults are injected by -inject-* and -abort-rate flags.
+	Faults []string `json:"faults,omitempty"`
+
+	Notes []string `json:"notes,omitempty"`
+	Tags  []string `json:"tags,omitempty"`
+	// Archive is the archive file the exchange was moved to.
+	Archive    string `json:"archive,omitempty"`
+	ArchiveURL string `json:"archive_url,omitempty"`
+}
+
+func exchangeID(dumpFilePrefix string) string {
+	return path.Base(dumpFilePrefix)
+}
+
+// globDumps returns dump files with the given suffix from dir and its
+// date subdirectories.
+func globDumps(dir, suffix string) ([]string, error) {
+	fNames, err := filepath.Glob(path.Join(dir, "*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	dated, err := filepath.Glob(path.Join(dir, dateDirPattern, "*"+suffix))
+	if err != nil {
+		return nil, err
+	}
+	return append(fNames, dated...), nil
+}
+
+// exchangePrefix returns the dump file prefix of the exchange, which may
+// be in a date subdirectory of dir. IDs start with the exchange date.
+func exchangePrefix(dir, id string) string {
+	if len(id) > len(dateDirFormat) {
+		prefix := path.Join(dir, id[:len(dateDirFormat)], id)
+		for _, suffix := range []string{suffixReqHeaders, suffixMeta} {
+			if _, err := os.Stat(prefix + suffix); err == nil {
+				return prefix
+			}
+		}
+	}
+	return path.Join(dir, id)
+}
+
+// sortIDs orders exchange IDs by time, then by the counter of exchanges
+// started within the same second.
+func sortIDs(ids []string) {
+	sort.Slice(ids, func(i, j int) bool {
+		ti, ci := splitID(ids[i])
+		tj, cj := splitID(ids[j])
+		if ti != tj {
+			return ti < tj
+		}
+		return ci < cj
+	})
+}
+
+// splitID splits an ID like 2006-01-02-15-04-05-10 into its time and
+// counter parts.
+func splitID(id string) (string, int) {
+	idx := strings.LastIndexByte(id, '-')
+	if idx < 0 {
+		return id, 0
+	}
+	counter, err := strconv.Atoi(id[idx+1:])
+	if err != nil {
+		return id, 0
+	}
+	return id[:idx], counter
+}
+
+// listExchanges returns IDs of all exchanges still present in the dump
+// directory, ordered by time, see sortIDs.
+func listExchanges(dir string) ([]string, error) {
+	fNames, err := globDumps(dir, suffixReqHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(fNames))
+	for _, fName := range fNames {
+		ids = append(ids, strings.TrimSuffix(path.Base(fName), suffixReqHeaders))
+	}
+	sortIDs(ids)
+	return ids, nil
+}
+
+// loadMeta reads the metadata of an exchange. An exchange without a
+// metadata file gets an empty one.
+func loadMeta(dir, id string) (*exchangeMeta, error) {
+	prefix := exchangePrefix(dir, id)
+	data, err := ioutil.ReadFile(prefix + suffixMeta)
+	if os.IsNotExist(err) {
+		if _, err := os.Stat(prefix + suffixReqHeaders); err != nil {
+			return nil, err
+		}
+		return &exchangeMeta{ID: id}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var meta exchangeMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("%v: %v", prefix+suffixMeta, err)
+	}
+	meta.ID = id
+	return &meta, nil
+}
+
+func saveMeta(dir string, meta *exchangeMeta) error {
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	fName := exchangePrefix(dir, meta.ID) + suffixMeta
+	tmpName := fName + ".tmp"
+	if err := ioutil.WriteFile(tmpName, append(data, '\n'), 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmpName, fName)
+}
+
+// recordMeta stores metadata of a completed exchange.
+func recordMeta(
+	fNamePrefix string,
+	r *http.Request,
+	url string,
+	statusCode int,
+	started time.Time,
+	faults []string,
+) {
+	if fNamePrefix == "" {
+		return
+	}
+
+	dir, id := path.Split(fNamePrefix)
+	meta, err := loadMeta(dir, id)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	meta.RequestID = requestID(r)
+	meta.Started = started
+	meta.DurationMS = milliseconds(time.Since(started))
+	meta.Method = r.Method
+	meta.URL = url
+	meta.Status = statusCode
+	meta.RequestSize = fileSize(fNamePrefix + suffixReqBody)
+	meta.ResponseSize = fileSize(fNamePrefix + suffixRespBody)
+	meta.Faults = faults
+	if err = saveMeta(dir, meta); err != nil {
+		log.Print(err)
+		return
+	}
+	err = appendIndex(indexDir(fNamePrefix), newIndexEntry(fNamePrefix, meta))
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func fileSize(fName string) int64 {
+	fi, err := os.Stat(fName)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// listMeta returns metadata of all exchanges that have a metadata file,
+// ordered by time, see sortIDs.
+func listMeta(dir string) ([]*exchangeMeta, error) {
+	fNames, err := globDumps(dir, suffixMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(fNames))
+	for _, fName := range fNames {
+		ids = append(ids, strings.TrimSuffix(path.Base(fName), suffixMeta))
+	}
+	sortIDs(ids)
+
+	metas := make([]*exchangeMeta, 0, len(ids))
+	for _, id := range ids {
+		meta, err := loadMeta(dir, id)
+		if err != nil {
+			return nil, err
+		}
+		metas = append(metas, meta)
+	}
+	return metas, nil
+}
+
+func (m *exchangeMeta) hasTag(tag string) bool {
+	for _, t := range m.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *exchangeMeta) addTags(tags []string) {
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !m.hasTag(tag) {
+			m.Tags = append(m.Tags, tag)
+		}
+	}
+}
+
+// annotateCmd implements `dumpproxy annotate [-note text] [-tag a,b] ID`.
+func annotateCmd(args []string) {
+	fs := flag.NewFlagSet("annotate", flag.ExitOnError)
+	dir := fs.String("dir", "./", "directory with dumped traffic")
+	note := fs.String("note", "", "free-form note to attach to the exchange")
+	tags := fs.String("tag", "", "comma separated list of tags to attach")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v annotate [flags] ID\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || (*note == "" && *tags == "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	meta, err := loadMeta(*dir, fs.Arg(0))
+	if err != nil {
+		panic(err)
+	}
+	if *note != "" {
+		meta.Notes = append(meta.Notes, *note)
+	}
+	meta.addTags(strings.Split(*tags, ","))
+	if err := saveMeta(*dir, meta); err != nil {
+		panic(err)
+	}
+}
+
+// taggedCmd implements `dumpproxy tagged TAG` and prints exchanges having
+// the tag together with their notes.
+func taggedCmd(args []string) {
+	fs := flag.NewFlagSet("tagged", flag.ExitOnError)
+	dir := fs.String("dir", "./", "directory with dumped traffic")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v tagged [flags] TAG\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	metas, err := listMeta(*dir)
+	if err != nil {
+		panic(err)
+	}
+	for _, meta := range metas {
+		if !meta.hasTag(fs.Arg(0)) {
+			continue
+		}
+		fmt.Printf("%v\t%v\n", meta.ID, strings.Join(meta.Tags, ","))
+		for _, note := range meta.Notes {
+			fmt.Printf("\t%v\n", note)
+		}
+	}
+}
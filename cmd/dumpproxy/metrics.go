@@ -0,0 +1,221 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var metricsAddr = flag.String(
+	"metrics-addr", "",
+	"address to serve Prometheus metrics on, they are also served on "+
+		"-admin-addr at /metrics",
+)
+
+// durationBuckets are upper bounds of duration histograms, in seconds.
+var durationBuckets = []float64{
+	0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30,
+}
+
+// counter is a Prometheus counter, optionally split by a single label.
+type counter struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *counter) add(labelValue string, v float64) {
+	c.mu.Lock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[labelValue] += v
+	c.mu.Unlock()
+}
+
+func (c *counter) write(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, err := fmt.Fprintf(
+		w, "# HELP %v %v\n# TYPE %v counter\n", c.name, c.help, c.name,
+	)
+	if err != nil {
+		return err
+	}
+	if c.label == "" {
+		_, err = fmt.Fprintf(w, "%v %v\n", c.name, formatFloat(c.values[""]))
+		return err
+	}
+
+	labelValues := make([]string, 0, len(c.values))
+	for labelValue := range c.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	for _, labelValue := range labelValues {
+		_, err = fmt.Fprintf(
+			w, "%v{%v=%q} %v\n",
+			c.name, c.label, labelValue, formatFloat(c.values[labelValue]),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// histogram is a Prometheus histogram of durations in seconds.
+type histogram struct {
+	name, help string
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+	h.mu.Unlock()
+}
+
+func (h *histogram) write(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	_, err := fmt.Fprintf(
+		w, "# HELP %v %v\n# TYPE %v histogram\n", h.name, h.help, h.name,
+	)
+	if err != nil {
+		return err
+	}
+	for i, bound := range durationBuckets {
+		var n uint64
+		if h.counts != nil {
+			n = h.counts[i]
+		}
+		_, err = fmt.Fprintf(
+			w, "%v_bucket{le=%q} %v\n", h.name, formatFloat(bound), n,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(
+		w, "%v_bucket{le=\"+Inf\"} %v\n%v_sum %v\n%v_count %v\n",
+		h.name, h.count, h.name, formatFloat(h.sum), h.name, h.count,
+	)
+	return err
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	requestsTotal = &counter{
+		name:  "dumpproxy_requests_total",
+		help:  "Requests handled by status code class.",
+		label: "code",
+	}
+	upstreamErrorsTotal = &counter{
+		name: "dumpproxy_upstream_errors_total",
+		help: "Requests failed because the upstream could not be reached.",
+	}
+	dumpedBytesTotal = &counter{
+		name: "dumpproxy_dumped_bytes_total",
+		help: "Bytes written to dump files.",
+	}
+	requestDuration = &histogram{
+		name: "dumpproxy_request_duration_seconds",
+		help: "Time from receiving a request to the end of its response.",
+	}
+	upstreamLatency = &histogram{
+		name: "dumpproxy_upstream_latency_seconds",
+		help: "Time from receiving a request to upstream response headers.",
+	}
+	dumpWriteDuration = &histogram{
+		name: "dumpproxy_dump_write_duration_seconds",
+		help: "Latency of writes to dump files.",
+	}
+)
+
+type metric interface {
+	write(w io.Writer) error
+}
+
+var allMetrics = []metric{
+	requestsTotal, upstreamErrorsTotal, dumpedBytesTotal,
+	requestDuration, upstreamLatency, dumpWriteDuration,
+}
+
+// statusClass returns the status code class label, e.g. 2xx. Requests
+// that failed before getting a status are counted as "error".
+func statusClass(statusCode int) string {
+	if statusCode < 100 || statusCode > 599 {
+		return "error"
+	}
+	return strconv.Itoa(statusCode/100) + "xx"
+}
+
+func serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range allMetrics {
+		if err := m.write(w); err != nil {
+			log.Printf("metrics: %v", err)
+			return
+		}
+	}
+}
+
+func runMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", serveMetrics)
+	log.Printf("metrics: listening on %v", addr)
+	log.Print(http.ListenAndServe(addr, mux))
+}
+
+// meteredWriter counts bytes and latency of writes to a dump file.
+type meteredWriter struct {
+	io.WriteCloser
+}
+
+func (mw meteredWriter) Write(p []byte) (int, error) {
+	started := time.Now()
+	n, err := mw.WriteCloser.Write(p)
+	dumpWriteDuration.observe(time.Since(started))
+	dumpedBytesTotal.add("", float64(n))
+	return n, err
+}
+
+// meteredTransport counts requests that failed to reach the upstream.
+type meteredTransport struct {
+	next http.RoundTripper
+}
+
+func (mt meteredTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := mt.next.RoundTrip(r)
+	if err != nil {
+		upstreamErrorsTotal.add("", 1)
+	}
+	return resp, err
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var redactHeaderList = flag.String(
+	"redact-header", "",
+	"comma separated header names to mask in dumps, e.g. Authorization,Cookie",
+)
+
+const redacted = "[REDACTED]"
+
+// redactRules mask sensitive data in dumps. Proxied traffic is never
+// changed. Query lists URL query parameters to mask, Body regex rules
+// apply to query parameter values as well.
+type redactRules struct {
+	Headers []string         `json:"headers,omitempty"`
+	Query   []string         `json:"query,omitempty"`
+	Body    []*bodyRedaction `json:"body,omitempty"`
+
+	headers map[string]bool
+	query   map[string]bool
+}
+
+// bodyRedaction replaces matches of Regex with Replace (default
+// "[REDACTED]") or values of JSON documents at JSONPath with "[REDACTED]".
+// JSONPath supports dotted keys, [n] indexes and * wildcards, e.g.
+// $.users[*].email.
+type bodyRedaction struct {
+	Regex    string `json:"regex,omitempty"`
+	Replace  string `json:"replace,omitempty"`
+	JSONPath string `json:"json_path,omitempty"`
+
+	re   *regexp.Regexp
+	path []string
+}
+
+var redaction = &redactRules{}
+
+func (rr *redactRules) compile(extraHeaders string) error {
+	rr.headers = make(map[string]bool)
+	for _, name := range rr.Headers {
+		rr.headers[http.CanonicalHeaderKey(name)] = true
+	}
+	for _, name := range strings.Split(extraHeaders, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			rr.headers[http.CanonicalHeaderKey(name)] = true
+		}
+	}
+	rr.query = make(map[string]bool)
+	for _, name := range rr.Query {
+		rr.query[name] = true
+	}
+
+	for i, rule := range rr.Body {
+		switch {
+		case rule.Regex != "" && rule.JSONPath != "":
+			return fmt.Errorf(
+				"body redaction %v: both regex and json_path are set", i,
+			)
+		case rule.Regex != "":
+			var err error
+			if rule.re, err = regexp.Compile(rule.Regex); err != nil {
+				return fmt.Errorf("body redaction %v: %v", i, err)
+			}
+			if rule.Replace == "" {
+				rule.Replace = redacted
+			}
+		case rule.JSONPath != "":
+			var err error
+			if rule.path, err = parseJSONPath(rule.JSONPath); err != nil {
+				return fmt.Errorf("body redaction %v: %v", i, err)
+			}
+		default:
+			return fmt.Errorf(
+				"body redaction %v: neither regex nor json_path is set", i,
+			)
+		}
+	}
+	return nil
+}
+
+var jsonPathSegment = regexp.MustCompile(`^(?:\.([^.\[\]]+)|\[(\*|\d+)\])`)
+
+func parseJSONPath(p string) ([]string, error) {
+	if !strings.HasPrefix(p, "$") {
+		return nil, fmt.Errorf("json path %v must start with $", p)
+	}
+	rest := p[1:]
+	var path []string
+	for rest != "" {
+		m := jsonPathSegment.FindStringSubmatch(rest)
+		if m == nil {
+			return nil, fmt.Errorf("malformed json path %v", p)
+		}
+		if m[1] != "" {
+			path = append(path, m[1])
+		} else {
+			path = append(path, m[2])
+		}
+		rest = rest[len(m[0]):]
+	}
+	if len(path) == 0 {
+		return nil, fmt.Errorf("json path %v selects the whole document", p)
+	}
+	return path, nil
+}
+
+// RedactHeader implements dumpproxy.Redactor.
+func (rr *redactRules) RedactHeader(name, value string) string {
+	if rr.headers[http.CanonicalHeaderKey(name)] {
+		return redacted
+	}
+	return value
+}
+
+// RedactQuery implements dumpproxy.Redactor. Parameters keep their order
+// and encoding unless they are redacted.
+func (rr *redactRules) RedactQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return rawQuery
+	}
+	params := strings.Split(rawQuery, "&")
+	for i, param := range params {
+		idx := strings.Index(param, "=")
+		if idx == -1 {
+			continue
+		}
+		name, value := param[:idx], param[idx+1:]
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if rr.query[name] {
+			params[i] = param[:idx+1] + url.QueryEscape(redacted)
+			continue
+		}
+		unescaped, err := url.QueryUnescape(value)
+		if err != nil {
+			unescaped = value
+		}
+		if result := rr.redactRegex(unescaped); result != unescaped {
+			params[i] = param[:idx+1] + url.QueryEscape(result)
+		}
+	}
+	return strings.Join(params, "&")
+}
+
+// redactURL returns u with its query redacted.
+func (rr *redactRules) redactURL(u string) string {
+	idx := strings.Index(u, "?")
+	if idx == -1 {
+		return u
+	}
+	return u[:idx+1] + rr.RedactQuery(u[idx+1:])
+}
+
+// RedactBody implements dumpproxy.Redactor.
+func (rr *redactRules) RedactBody(w io.Writer) io.WriteCloser {
+	if len(rr.Body) == 0 {
+		return nil
+	}
+	return &redactingWriter{rr: rr, w: w}
+}
+
+// redactRegex applies regex body rules to s.
+func (rr *redactRules) redactRegex(s string) string {
+	for _, rule := range rr.Body {
+		if rule.re != nil {
+			s = rule.re.ReplaceAllString(s, rule.Replace)
+		}
+	}
+	return s
+}
+
+func (rr *redactRules) redactBody(data []byte) []byte {
+	for _, rule := range rr.Body {
+		if rule.re != nil {
+			data = rule.re.ReplaceAll(data, []byte(rule.Replace))
+		} else if json.Valid(data) {
+			data = redactJSON(data, rule.path)
+		}
+	}
+	return data
+}
+
+// redactJSON replaces values of the valid JSON document data at path with
+// "[REDACTED]", the rest of the document is kept byte for byte.
+func redactJSON(data []byte, path []string) []byte {
+	var spans [][2]int
+	scanJSON(data, skipJSONSpace(data, 0), path, &spans)
+	if len(spans) == 0 {
+		return data
+	}
+
+	var buf bytes.Buffer
+	last := 0
+	for _, span := range spans {
+		buf.Write(data[last:span[0]])
+		buf.WriteString(strconv.Quote(redacted))
+		last = span[1]
+	}
+	buf.Write(data[last:])
+	return buf.Bytes()
+}
+
+// scanJSON returns the end of the JSON value starting at i and appends
+// spans of values at path below it to spans. path is nil if nothing below
+// the value matches.
+func scanJSON(data []byte, i int, path []string, spans *[][2]int) int {
+	// value scans the value at i which is key or index of its parent.
+	value := func(key string) {
+		if path == nil || (path[0] != "*" && path[0] != key) {
+			i = scanJSON(data, i, nil, nil)
+		} else if len(path) == 1 {
+			end := scanJSON(data, i, nil, nil)
+			*spans = append(*spans, [2]int{i, end})
+			i = end
+		} else {
+			i = scanJSON(data, i, path[1:], spans)
+		}
+		i = skipJSONSpace(data, i)
+	}
+
+	switch data[i] {
+	case '{':
+		i = skipJSONSpace(data, i+1)
+		for data[i] != '}' {
+			keyEnd := scanJSONString(data, i)
+			var key string
+			_ = json.Unmarshal(data[i:keyEnd], &key)
+			// Skip the colon.
+			i = skipJSONSpace(data, skipJSONSpace(data, keyEnd)+1)
+			value(key)
+			if data[i] == ',' {
+				i = skipJSONSpace(data, i+1)
+			}
+		}
+		return i + 1
+	case '[':
+		i = skipJSONSpace(data, i+1)
+		for n := 0; data[i] != ']'; n++ {
+			value(strconv.Itoa(n))
+			if data[i] == ',' {
+				i = skipJSONSpace(data, i+1)
+			}
+		}
+		return i + 1
+	case '"':
+		return scanJSONString(data, i)
+	default:
+		// A number, true, false or null.
+		for i < len(data) && !strings.ContainsRune(",]} \t\r\n", rune(data[i])) {
+			i++
+		}
+		return i
+	}
+}
+
+// scanJSONString returns the end of the JSON string starting at i.
+func scanJSONString(data []byte, i int) int {
+	for i++; data[i] != '"'; i++ {
+		if data[i] == '\\' {
+			i++
+		}
+	}
+	return i + 1
+}
+
+func skipJSONSpace(data []byte, i int) int {
+	for i < len(data) && strings.ContainsRune(" \t\r\n", rune(data[i])) {
+		i++
+	}
+	return i
+}
+
+// maxRedactedBodySize limits bodies kept in memory to be redacted. Rules
+// can't be applied to larger bodies piece by piece, so their dumps only
+// note the size.
+const maxRedactedBodySize = 10 << 20
+
+// redactingWriter collects a body dump and writes it redacted on Close.
+// Bodies have to be complete to match rules spanning several writes.
+type redactingWriter struct {
+	rr  *redactRules
+	buf bytes.Buffer
+	w   io.Writer
+	// dropped is the size of a body over maxRedactedBodySize, it's not
+	// kept.
+	dropped int64
+}
+
+func (rw *redactingWriter) Write(p []byte) (int, error) {
+	if rw.dropped == 0 && rw.buf.Len()+len(p) <= maxRedactedBodySize {
+		return rw.buf.Write(p)
+	}
+	if rw.dropped == 0 {
+		rw.dropped = int64(rw.buf.Len())
+		rw.buf = bytes.Buffer{}
+	}
+	rw.dropped += int64(len(p))
+	return len(p), nil
+}
+
+func (rw *redactingWriter) Close() error {
+	if rw.dropped > 0 {
+		_, err := fmt.Fprintf(
+			rw.w, "%v body of %v bytes is too large to redact", redacted,
+			rw.dropped,
+		)
+		return err
+	}
+	_, err := rw.w.Write(rw.rr.redactBody(rw.buf.Bytes()))
+	return err
+}
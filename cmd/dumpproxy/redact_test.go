@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// compiledRules returns redaction rules for tests.
+func compiledRules(t *testing.T, rr *redactRules) *redactRules {
+	if err := rr.compile(""); err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestRedactJSON(t *testing.T) {
+	testCases := []struct {
+		name string
+		path string
+		in   string
+		want string
+	}{
+		{
+			name: "key",
+			path: "$.user.email",
+			in:   `{"user":{"email":"a@b.c","id":1}}`,
+			want: `{"user":{"email":"[REDACTED]","id":1}}`,
+		},
+		{
+			name: "keeps order, spacing and escaping",
+			path: "$.b",
+			in:   "{ \"z\" : \"<&>\",\n  \"b\" : 1.5e3 , \"a\":[true] }",
+			want: "{ \"z\" : \"<&>\",\n  \"b\" : \"[REDACTED]\" , \"a\":[true] }",
+		},
+		{
+			name: "wildcard",
+			path: "$.items[*].card",
+			in:   `{"items":[{"card":"1"},{"id":2},{"card":{"n":[3]}}]}`,
+			want: `{"items":[{"card":"[REDACTED]"},{"id":2},{"card":"[REDACTED]"}]}`,
+		},
+		{
+			name: "index",
+			path: "$[1]",
+			in:   `["a", "b", "c"]`,
+			want: `["a", "[REDACTED]", "c"]`,
+		},
+		{
+			name: "escaped key",
+			path: "$.ab",
+			in:   `{"a\u0062":"secret"}`,
+			want: `{"a\u0062":"[REDACTED]"}`,
+		},
+		{
+			name: "strings with delimiters",
+			path: "$.b",
+			in:   `{"a":"}\"],{","b":"x"}`,
+			want: `{"a":"}\"],{","b":"[REDACTED]"}`,
+		},
+		{
+			name: "no match",
+			path: "$.a.b",
+			in:   `{"a":null,"b":{}}`,
+			want: `{"a":null,"b":{}}`,
+		},
+		{
+			name: "empty containers",
+			path: "$.a[*]",
+			in:   `{"a":[],"b":{}}`,
+			want: `{"a":[],"b":{}}`,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path, err := parseJSONPath(tc.path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := string(redactJSON([]byte(tc.in), path))
+			if got != tc.want {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRedactingWriter(t *testing.T) {
+	rr := compiledRules(t, &redactRules{Body: []*bodyRedaction{
+		{Regex: `\d{16}`},
+		{JSONPath: "$.email"},
+	}})
+
+	var buf bytes.Buffer
+	w := rr.RedactBody(&buf)
+	// A match split between writes is still found.
+	for _, part := range []string{`{"card":"12345678`, `87654321","email":"a@b"}`} {
+		if _, err := w.Write([]byte(part)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if buf.Len() != 0 {
+		t.Errorf("body written before Close: %q", buf.String())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"card":"[REDACTED]","email":"[REDACTED]"}`
+	if buf.String() != want {
+		t.Errorf("got %v, want %v", buf.String(), want)
+	}
+
+	buf.Reset()
+	w = rr.RedactBody(&buf)
+	chunk := bytes.Repeat([]byte("1"), 1<<20)
+	for i := 0; i <= maxRedactedBodySize>>20; i++ {
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), redacted+" body of 11534336 bytes") {
+		t.Errorf("oversized body dump = %q", buf.String())
+	}
+
+	if w := compiledRules(t, &redactRules{}).RedactBody(&buf); w != nil {
+		t.Errorf("got a body writer without body rules")
+	}
+}
+
+func TestRedactQuery(t *testing.T) {
+	rr := compiledRules(t, &redactRules{
+		Query: []string{"token"},
+		Body:  []*bodyRedaction{{Regex: `\d{16}`}},
+	})
+	testCases := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"a=1&token=secret&b", "a=1&token=%5BREDACTED%5D&b"},
+		{"to%6Ben=secret", "to%6Ben=%5BREDACTED%5D"},
+		{"card=1234567812345678&z=%2F", "card=%5BREDACTED%5D&z=%2F"},
+	}
+	for _, tc := range testCases {
+		if got := rr.RedactQuery(tc.in); got != tc.want {
+			t.Errorf("RedactQuery(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+	got := rr.redactURL("https://example.com/p?token=x")
+	if got != "https://example.com/p?token=%5BREDACTED%5D" {
+		t.Errorf("redactURL = %q", got)
+	}
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/olomix/dumpproxy"
+)
+
+const (
+	modeProxy  = "proxy"
+	modeReplay = "replay"
+)
+
+var mode = flag.String(
+	"mode", modeProxy,
+	"proxy to forward traffic to upstream, replay to serve dumped responses",
+)
+var replayMatch = flag.String(
+	"replay-match", "",
+	"comma separated extra keys to match replayed requests by besides "+
+		"method and path: query, body, header:<Name>",
+)
+var replayFallthrough = flag.Bool(
+	"replay-fallthrough", false,
+	"proxy unmatched requests to upstream instead of responding 404",
+)
+
+type replayEntry struct {
+	prefix     string
+	statusCode int
+	header     http.Header
+}
+
+// replayer serves responses from the dump directory. Requests matching
+// several dumped exchanges get their responses in the recorded order, the
+// last one is repeated once they are exhausted.
+type replayer struct {
+	matchKeys []string
+
+	mu      sync.Mutex
+	entries map[string][]*replayEntry
+	next    map[string]int
+}
+
+func parseMatchKeys(spec string) ([]string, error) {
+	var keys []string
+	for _, key := range strings.Split(spec, ",") {
+		key = strings.TrimSpace(key)
+		switch {
+		case key == "":
+			continue
+		case key == "query", key == "body":
+		case strings.HasPrefix(key, "header:") && len(key) > len("header:"):
+		default:
+			return nil, fmt.Errorf("unknown replay match key %v", key)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func loadReplayer(dir string, matchKeys []string) (*replayer, error) {
+	rp := &replayer{
+		matchKeys: matchKeys,
+		entries:   make(map[string][]*replayEntry),
+		next:      make(map[string]int),
+	}
+
+	ids, err := listExchanges(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		prefix := exchangePrefix(dir, id)
+		if incompleteReason(prefix) != "" {
+			continue
+		}
+
+		key, err := rp.dumpedRequestKey(prefix)
+		var entry *replayEntry
+		if err == nil {
+			entry, err = loadReplayEntry(prefix)
+		}
+		if err == nil && entry.statusCode == http.StatusSwitchingProtocols {
+			err = errNotReplayable
+		}
+		if err == nil {
+			var meta *exchangeMeta
+			meta, err = loadMeta(dir, id)
+			if err == nil && faultedResponse(meta.Faults) {
+				err = errNotReplayable
+			}
+		}
+		if err == errNotReplayable {
+			continue
+		}
+		if err != nil {
+			// One broken dump shouldn't keep the rest from being served.
+			log.Printf("replay: skip %v: %v", id, err)
+			continue
+		}
+		rp.entries[key] = append(rp.entries[key], entry)
+	}
+	return rp, nil
+}
+
+// errNotReplayable marks exchanges that can't be served again: CONNECT
+// tunnels and protocol upgrades, their traffic isn't HTTP, and responses
+// made up or cut off by injected faults.
+var errNotReplayable = errors.New("not replayable")
+
+// readHeadersDump parses a headers dump file into its first line and
+// headers.
+func readHeadersDump(fName string) (string, http.Header, error) {
+	f, err := os.Open(fName)
+	if err != nil {
+		return "", nil, err
+	}
+	defer closeLogError(f)
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	if !scanner.Scan() {
+		if scanner.Err() != nil {
+			return "", nil, scanner.Err()
+		}
+		return "", nil, fmt.Errorf("%v is empty", fName)
+	}
+	firstLine := scanner.Text()
+
+	header := make(http.Header)
+	for scanner.Scan() {
+		idx := strings.Index(scanner.Text(), ": ")
+		if idx < 0 {
+			continue
+		}
+		header.Add(scanner.Text()[:idx], scanner.Text()[idx+2:])
+	}
+	return firstLine, header, scanner.Err()
+}
+
+func (rp *replayer) dumpedRequestKey(prefix string) (string, error) {
+	firstLine, header, err := readHeadersDump(prefix + suffixReqHeaders)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.Fields(firstLine)
+	if len(parts) < 2 {
+		return "", fmt.Errorf("malformed request line %q", firstLine)
+	}
+	if parts[0] == http.MethodConnect {
+		return "", errNotReplayable
+	}
+	u, err := url.ParseRequestURI(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	var bodyHash string
+	if rp.matchesBody() {
+		f, err := os.Open(prefix + suffixReqBody)
+		if err != nil {
+			return "", err
+		}
+		defer closeLogError(f)
+		if bodyHash, err = hashBody(f); err != nil {
+			return "", err
+		}
+	}
+	return rp.key(parts[0], u, header, bodyHash), nil
+}
+
+func loadReplayEntry(prefix string) (*replayEntry, error) {
+	statusLine, header, err := readHeadersDump(prefix + suffixRespHeaders)
+	if err != nil {
+		return nil, err
+	}
+	statusCode, err := strconv.Atoi(strings.SplitN(statusLine, " ", 2)[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed status line %q", statusLine)
+	}
+
+	// The encoding header doesn't apply to decoded body dumps.
+	if header.Get(dumpproxy.HeaderDecodedFrom) != "" {
+		header.Del("Content-Encoding")
+		header.Del(dumpproxy.HeaderDecodedFrom)
+	}
+	header.Del("Content-Length")
+	// Dumped trailers are served as headers.
+	dumpproxy.RemoveHopHeaders(header)
+
+	return &replayEntry{prefix: prefix, statusCode: statusCode, header: header}, nil
+}
+
+func (rp *replayer) matchesBody() bool {
+	for _, key := range rp.matchKeys {
+		if key == "body" {
+			return true
+		}
+	}
+	return false
+}
+
+func (rp *replayer) key(
+	method string,
+	u *url.URL,
+	header http.Header,
+	bodyHash string,
+) string {
+	parts := []string{method, u.Path}
+	for _, key := range rp.matchKeys {
+		switch {
+		case key == "query":
+			parts = append(parts, u.RawQuery)
+		case key == "body":
+			parts = append(parts, bodyHash)
+		case strings.HasPrefix(key, "header:"):
+			parts = append(parts, header.Get(strings.TrimPrefix(key, "header:")))
+		}
+	}
+	return strings.Join(parts, "\x00")
+}
+
+func hashBody(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (rp *replayer) lookup(key string) *replayEntry {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	entries := rp.entries[key]
+	if len(entries) == 0 {
+		return nil
+	}
+	idx := rp.next[key]
+	if idx < len(entries)-1 {
+		rp.next[key] = idx + 1
+	}
+	return entries[idx]
+}
+
+func (rp *replayer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+	var bodyHash string
+	if rp.matchesBody() {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			logRequest(r, http.StatusBadRequest, "", started, 0, err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// Keep the body for the upstream in case of fall through.
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		bodyHash, _ = hashBody(bytes.NewReader(body))
+	}
+
+	entry := rp.lookup(rp.key(r.Method, r.URL, r.Header, bodyHash))
+	if entry == nil {
+		if *replayFallthrough {
+			proxy(w, r)
+			return
+		}
+		logRequest(r, http.StatusNotFound, "", started, 0, nil)
+		http.NotFound(w, r)
+		return
+	}
+
+	statusCode, err := serveReplayEntry(w, entry)
+	logRequest(r, statusCode, entry.prefix, started, 0, err)
+}
+
+// serveReplayEntry responds with the dumped response and returns the
+// status sent.
+func serveReplayEntry(
+	w http.ResponseWriter,
+	entry *replayEntry,
+) (int, error) {
+	body, err := os.Open(entry.prefix + suffixRespBody)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return http.StatusInternalServerError, err
+	}
+	defer closeLogError(body)
+
+	fi, err := body.Stat()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return http.StatusInternalServerError, err
+	}
+
+	for header, values := range entry.header {
+		for _, value := range values {
+			w.Header().Add(header, value)
+		}
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
+	w.WriteHeader(entry.statusCode)
+	_, err = io.Copy(w, body)
+	return entry.statusCode, err
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+)
+
+// writeDump writes dump files of a GET exchange to dir.
+func writeDump(
+	t *testing.T,
+	dir, id, reqPath, respBody string,
+	faults []string,
+) {
+	files := map[string]string{
+		suffixReqHeaders:  "GET " + reqPath + " HTTP/1.1\nHost: example.com\n",
+		suffixReqBody:     "",
+		suffixRespHeaders: "200 OK\nContent-Type: text/plain\n",
+		suffixRespBody:    respBody,
+	}
+	for suffix, content := range files {
+		fName := path.Join(dir, id+suffix)
+		if err := ioutil.WriteFile(fName, []byte(content), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := saveMeta(dir, &exchangeMeta{ID: id, Faults: faults}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayerSkipsFaultedResponses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	writeDump(t, dir, "2024-05-01-10-00-00-0", "/a", "cut", []string{
+		"latency 10ms", "abort after 3 bytes",
+	})
+	writeDump(t, dir, "2024-05-01-10-00-00-1", "/a", "full", []string{
+		"latency 10ms",
+	})
+	writeDump(t, dir, "2024-05-01-10-00-00-2", "/b", "", []string{
+		"error 503",
+	})
+
+	rp, err := loadReplayer(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testCases := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/a", http.StatusOK, "full"},
+		{"/a", http.StatusOK, "full"},
+		{"/b", http.StatusNotFound, "404 page not found\n"},
+	}
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		rp.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tc.path, nil))
+		if w.Code != tc.status || w.Body.String() != tc.body {
+			t.Errorf("GET %v: %v %q", tc.path, w.Code, w.Body.String())
+		}
+	}
+}
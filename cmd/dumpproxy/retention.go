@@ -0,0 +1,322 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/olomix/dumpproxy"
+)
+
+const (
+	dirLayoutFlat = "flat"
+	dirLayoutDate = "date"
+)
+
+// dateDirFormat names date subdirectories, exchange IDs start with the
+// same date.
+const dateDirFormat = dumpproxy.DateDirFormat
+const dateDirPattern = "[0-9][0-9][0-9][0-9]-[0-9][0-9]-[0-9][0-9]"
+
+var dirLayout = flag.String(
+	"dir-layout", dirLayoutFlat,
+	"where to put dumps: flat (all in dir) or date (dir/2006-01-02/...)",
+)
+var maxDumpAge = flag.Duration(
+	"max-dump-age", 0, "delete exchanges older than this, 0 disables",
+)
+var maxDumpFiles = flag.Int(
+	"max-dump-files", 0,
+	"keep at most this many exchanges per dump directory, 0 disables",
+)
+var maxDumpSize byteSize
+var retentionInterval = flag.Duration(
+	"retention-interval", time.Minute, "how often to enforce dump limits",
+)
+
+func init() {
+	flag.Var(
+		&maxDumpSize, "max-dump-size",
+		"keep dumps of each dump directory under this size, e.g. 500M or 5G, "+
+			"0 disables",
+	)
+}
+
+// byteSize is a flag value of a size in bytes with an optional K, M, G or
+// T suffix, e.g. 64K or 1.5G.
+type byteSize int64
+
+func (s *byteSize) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *byteSize) Set(orig string) error {
+	value := strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(orig)), "B")
+	multiplier := int64(1)
+	if i := strings.IndexAny(value, "KMGT"); i != -1 && i == len(value)-1 {
+		for _, unit := range "KMGT" {
+			multiplier *= 1024
+			if rune(value[i]) == unit {
+				break
+			}
+		}
+		value = value[:i]
+	}
+	if strings.Contains(value, ".") {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil || strings.Trim(value, "0123456789.") != "" {
+			return fmt.Errorf("invalid size %v", orig)
+		}
+		if f*float64(multiplier) >= math.MaxInt64 {
+			return fmt.Errorf("size %v is too large", orig)
+		}
+		*s = byteSize(f * float64(multiplier))
+		return nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return fmt.Errorf("invalid size %v", orig)
+	}
+	if n > math.MaxInt64/multiplier {
+		return fmt.Errorf("size %v is too large", orig)
+	}
+	*s = byteSize(n * multiplier)
+	return nil
+}
+
+func validDirLayout(layout string) bool {
+	return layout == dirLayoutFlat || layout == dirLayoutDate
+}
+
+func retentionEnabled() bool {
+	return *maxDumpAge > 0 || *maxDumpFiles > 0 || maxDumpSize > 0
+}
+
+// runRetention periodically deletes the oldest exchanges and archives of
+// dir until it fits the -max-dump-* limits.
+func runRetention(dir string) {
+	ticker := time.NewTicker(*retentionInterval)
+	defer ticker.Stop()
+	for {
+		if err := enforceRetention(dir); err != nil {
+			log.Printf("retention: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func enforceRetention(dir string) error {
+	ids, err := listExchanges(dir)
+	if err != nil {
+		return err
+	}
+	archives, err := listArchives(archiveDirOf(dir))
+	if err != nil {
+		return err
+	}
+
+	prefixes := make([]string, len(ids))
+	sizes := make([]int64, len(ids))
+	var total int64
+	for i, id := range ids {
+		prefixes[i] = exchangePrefix(dir, id)
+		for _, suffix := range append(allDumpSuffixes(), suffixMeta) {
+			sizes[i] += fileSize(prefixes[i] + suffix)
+		}
+		total += sizes[i]
+	}
+	for _, fi := range archives {
+		total += fi.Size()
+	}
+	archivedMeta, err := archivedMetaSizes(dir)
+	if err != nil {
+		return err
+	}
+	for _, size := range archivedMeta {
+		total += size
+	}
+	total += fileSize(path.Join(dir, indexFileName))
+
+	cutoff := time.Now().Add(-*maxDumpAge)
+	overSize := func() bool {
+		return maxDumpSize > 0 && total > int64(maxDumpSize)
+	}
+
+	// Archives hold the oldest exchanges, they go first.
+	deletedArchives := 0
+	for _, fi := range archives {
+		expired := *maxDumpAge > 0 && fi.ModTime().Before(cutoff)
+		if !expired && !overSize() {
+			break
+		}
+		aName := path.Join(archiveDirOf(dir), fi.Name())
+		err := os.Remove(aName)
+		if err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+			continue
+		}
+		// Metadata of archived exchanges goes with the archive below.
+		total -= fi.Size() + archivedMeta[aName]
+		deletedArchives++
+	}
+
+	deleted := make(map[string]bool)
+	// IDs are ordered by time, so are exchanges.
+	for i, prefix := range prefixes {
+		expired := false
+		if *maxDumpAge > 0 {
+			modTime, err := exchangeModTime(prefix)
+			if err != nil {
+				return err
+			}
+			expired = modTime.Before(cutoff)
+		}
+		if !expired &&
+			(*maxDumpFiles <= 0 || len(ids)-len(deleted) <= *maxDumpFiles) &&
+			!overSize() {
+			break
+		}
+		deleteExchange(prefix)
+		total -= sizes[i]
+		deleted[ids[i]] = true
+	}
+
+	archivedIDs, err := deleteArchivedMeta(dir)
+	if err != nil {
+		return err
+	}
+	if deletedArchives > 0 {
+		log.Printf(
+			"retention: deleted %v archives of %v", deletedArchives, dir,
+		)
+	}
+	if len(deleted) > 0 {
+		log.Printf("retention: deleted %v exchanges from %v", len(deleted), dir)
+		removeOldDateDirs(dir)
+	}
+	for _, id := range archivedIDs {
+		deleted[id] = true
+	}
+	if len(deleted) > 0 {
+		return trimIndex(dir, deleted)
+	}
+	return nil
+}
+
+// listArchives returns archives in aDir ordered by name, which is by
+// time.
+func listArchives(aDir string) ([]os.FileInfo, error) {
+	fis, err := ioutil.ReadDir(aDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	archives := fis[:0]
+	for _, fi := range fis {
+		if fi.Mode().IsRegular() &&
+			strings.HasSuffix(fi.Name(), archiveSuffix) {
+			archives = append(archives, fi)
+		}
+	}
+	return archives, nil
+}
+
+// archivedMetaSizes returns the size of metadata files left in dir by
+// archived exchanges, by archive.
+func archivedMetaSizes(dir string) (map[string]int64, error) {
+	fNames, err := globDumps(dir, suffixMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	sizes := make(map[string]int64)
+	for _, fName := range fNames {
+		prefix := strings.TrimSuffix(fName, suffixMeta)
+		if _, err := os.Stat(prefix + suffixReqHeaders); err == nil {
+			// Not archived, counted with the exchange.
+			continue
+		}
+		meta, err := loadMeta(dir, exchangeID(prefix))
+		if err != nil {
+			log.Printf("retention: %v", err)
+			continue
+		}
+		sizes[meta.Archive] += fileSize(fName)
+	}
+	return sizes, nil
+}
+
+// deleteArchivedMeta deletes metadata left in dir by archived exchanges
+// whose archive is gone and returns IDs of those exchanges.
+func deleteArchivedMeta(dir string) ([]string, error) {
+	fNames, err := globDumps(dir, suffixMeta)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, fName := range fNames {
+		prefix := strings.TrimSuffix(fName, suffixMeta)
+		if _, err := os.Stat(prefix + suffixReqHeaders); err == nil {
+			// Not archived.
+			continue
+		}
+		meta, err := loadMeta(dir, exchangeID(prefix))
+		if err != nil {
+			log.Printf("retention: %v", err)
+			continue
+		}
+		if meta.Archive == "" {
+			continue
+		}
+		if _, err := os.Stat(meta.Archive); !os.IsNotExist(err) {
+			continue
+		}
+		if err := os.Remove(fName); err != nil {
+			log.Print(err)
+			continue
+		}
+		ids = append(ids, meta.ID)
+	}
+	return ids, nil
+}
+
+// deleteExchange removes all files of the exchange. Request headers go
+// first: an exchange without them is not listed anymore and is treated
+// as incomplete on startup if deleting the rest fails.
+func deleteExchange(dumpFilePrefix string) {
+	for _, suffix := range append(allDumpSuffixes(), suffixMeta) {
+		err := os.Remove(dumpFilePrefix + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			log.Print(err)
+		}
+	}
+}
+
+// removeOldDateDirs removes empty date subdirectories of dir. Today's
+// directory is kept as new exchanges may be created in it at any moment.
+func removeOldDateDirs(dir string) {
+	today := time.Now().Format(dateDirFormat)
+	dateDirs, err := filepath.Glob(path.Join(dir, dateDirPattern))
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, dateDir := range dateDirs {
+		if path.Base(dateDir) >= today {
+			continue
+		}
+		// Fails unless the directory is empty, that's fine.
+		_ = os.Remove(dateDir)
+	}
+}
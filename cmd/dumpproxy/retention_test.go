@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// archivedDir returns a dump directory with one exchange packed into an
+// archive.
+func archivedDir(t *testing.T, root, name string) string {
+	dir := path.Join(root, name)
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	prefix := path.Join(dir, "2024-05-01-10-00-00-0")
+	for _, suffix := range []string{suffixReqHeaders, suffixRespBody} {
+		err := ioutil.WriteFile(prefix+suffix, []byte("dump"), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := archiveOnce(dir, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestEnforceRetentionSharedArchiveDir(t *testing.T) {
+	root, err := ioutil.TempDir("", "dumpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(root) }()
+	defer func(old string) { *archiveDir = old }(*archiveDir)
+	defer func(old byteSize) { maxDumpSize = old }(maxDumpSize)
+	*archiveDir = path.Join(root, "archives")
+
+	dirA := archivedDir(t, root, "a")
+	dirB := archivedDir(t, root, "b")
+	if archiveDirOf(dirA) == archiveDirOf(dirB) {
+		t.Fatalf("both dirs archive to %v", archiveDirOf(dirA))
+	}
+
+	maxDumpSize = 1
+	if err = enforceRetention(dirA); err != nil {
+		t.Fatal(err)
+	}
+	for dir, want := range map[string]int{dirA: 0, dirB: 1} {
+		archives, err := listArchives(archiveDirOf(dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(archives) != want {
+			t.Errorf("%v has %v archives, want %v", dir, len(archives), want)
+		}
+	}
+}
+
+func TestByteSizeSet(t *testing.T) {
+	testCases := []struct {
+		in      string
+		want    byteSize
+		wantErr bool
+	}{
+		{in: "100", want: 100},
+		{in: "1k", want: 1024},
+		{in: "64K", want: 64 << 10},
+		{in: "500MB", want: 500 << 20},
+		{in: "1.5G", want: 3 << 29},
+		{in: "2t", want: 2 << 40},
+		{in: "0.5k", want: 512},
+		{in: "8388607T", want: 8388607 << 40},
+		{in: "8388608T", wantErr: true},
+		{in: "9.3e18", wantErr: true},
+		{in: "1e3K", wantErr: true},
+		{in: "-1K", wantErr: true},
+		{in: "1KK", wantErr: true},
+		{in: "K", wantErr: true},
+		{in: "lots", wantErr: true},
+		{in: "", wantErr: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			var s byteSize
+			err := s.Set(tc.in)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("Set(%q) error = %v", tc.in, err)
+			}
+			if s != tc.want {
+				t.Errorf("Set(%q) = %v, want %v", tc.in, s, tc.want)
+			}
+		})
+	}
+}
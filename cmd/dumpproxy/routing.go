@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+var configFile = flag.String(
+	"config", "",
+	"JSON config file with routing rules, requests matching no rule go to "+
+		"-upstream-addr",
+)
+
+// config is the format of the -config file:
+//
+//	{
+//	  "routes": [
+//	    {"host": "api.example.com", "upstream": "10.0.0.5:8000"},
+//	    {"path_prefix": "/auth", "upstream": "10.0.0.6:9443",
+//	     "scheme": "https", "tls_server_name": "auth.example.com",
+//	     "dir": "./dumps/auth"}
+//	  ],
+//	  "capture": {
+//	    "include": [{"path": "^/api/"}],
+//	    "exclude": [{"method": "OPTIONS"}, {"status": "3xx"}]
+//	  },
+//	  "redact": {
+//	    "headers": ["Authorization", "Cookie"],
+//	    "query": ["token"],
+//	    "body": [{"json_path": "$.user.email"}, {"regex": "\\d{16}"}]
+//	  }
+//	}
+type config struct {
+	Routes  []*route     `json:"routes"`
+	Capture captureRules `json:"capture"`
+	Redact  redactRules  `json:"redact"`
+}
+
+// route sends requests matching Host and PathPrefix to Upstream. Empty
+// Host or PathPrefix match any request, empty Scheme and Dir default to
+// -upstream-scheme and -dir. TLSServerName is sent to https upstreams
+// instead of the host of Upstream.
+type route struct {
+	Host          string `json:"host,omitempty"`
+	PathPrefix    string `json:"path_prefix,omitempty"`
+	Upstream      string `json:"upstream"`
+	Scheme        string `json:"scheme,omitempty"`
+	TLSServerName string `json:"tls_server_name,omitempty"`
+	Dir           string `json:"dir,omitempty"`
+}
+
+// routes are the configured rules in order followed by the default route
+// built from flags.
+var routes []*route
+
+// configMu guards routes, capture and redaction, which are replaced when
+// the config is reloaded on SIGHUP.
+var configMu sync.RWMutex
+
+func currentRoutes() []*route {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return routes
+}
+
+// ruleSet is a snapshot of routing, capture and redaction rules. An
+// exchange keeps the snapshot taken when it started, so a reload never
+// changes the rules mid-exchange.
+type ruleSet struct {
+	routes    []*route
+	capture   *captureRules
+	redaction *redactRules
+}
+
+func currentRules() *ruleSet {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return &ruleSet{routes: routes, capture: capture, redaction: redaction}
+}
+
+// loadRules reads -config and builds routing, capture and redaction rules
+// from it and flags.
+func loadRules() ([]*route, *captureRules, *redactRules, error) {
+	var err error
+	cfg := &config{}
+	if *configFile != "" {
+		if cfg, err = loadConfig(*configFile); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	newRoutes, err := setupRoutes(cfg)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err = cfg.Capture.compile(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err = cfg.Redact.compile(*redactHeaderList); err != nil {
+		return nil, nil, nil, err
+	}
+	for _, dir := range routeDirs(newRoutes) {
+		fileInfo, err := os.Stat(dir)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if !fileInfo.IsDir() {
+			return nil, nil, nil, fmt.Errorf("%v is not a directory", dir)
+		}
+	}
+	return newRoutes, &cfg.Capture, &cfg.Redact, nil
+}
+
+// setRules makes rules take effect for requests that are not started
+// yet.
+func setRules(
+	newRoutes []*route,
+	newCapture *captureRules,
+	newRedaction *redactRules,
+) {
+	configMu.Lock()
+	routes, capture, redaction = newRoutes, newCapture, newRedaction
+	configMu.Unlock()
+}
+
+// reloadRules replaces rules with ones loaded from -config, current rules
+// are kept if the config is broken. Dump directories new to the config
+// are cleaned up and maintained like the ones found on startup.
+func reloadRules() {
+	if *configFile == "" {
+		log.Print("reload config: no -config to reload")
+		return
+	}
+	newRoutes, newCapture, newRedaction, err := loadRules()
+	if err != nil {
+		log.Printf("reload config: %v", err)
+		return
+	}
+	// New directories are cleaned up before exchanges are dumped there.
+	if err = manageDirs(routeDirs(newRoutes)); err != nil {
+		log.Printf("reload config: %v", err)
+	}
+	setRules(newRoutes, newCapture, newRedaction)
+	log.Printf("reloaded config %v", *configFile)
+}
+
+// managedDirs are dump directories maintenance was started for.
+var (
+	managedDirs   = make(map[string]bool)
+	managedDirsMu sync.Mutex
+)
+
+// manageDirs discards incomplete exchanges in dirs and starts archiving
+// and retention of them unless it was done before.
+func manageDirs(dirs []string) error {
+	managedDirsMu.Lock()
+	defer managedDirsMu.Unlock()
+	for _, dir := range dirs {
+		if managedDirs[dir] {
+			continue
+		}
+		if err := cleanupIncomplete(dir); err != nil {
+			return err
+		}
+		managedDirs[dir] = true
+		if *archiveAfter > 0 {
+			go runArchiver(dir)
+		}
+		if retentionEnabled() {
+			go runRetention(dir)
+		}
+	}
+	return nil
+}
+
+func loadConfig(fName string) (*config, error) {
+	data, err := ioutil.ReadFile(fName)
+	if err != nil {
+		return nil, err
+	}
+	var cfg config
+	if err = json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("%v: %v", fName, err)
+	}
+	return &cfg, nil
+}
+
+func setupRoutes(cfg *config) ([]*route, error) {
+	result := make([]*route, 0, len(cfg.Routes)+1)
+	for i, rt := range cfg.Routes {
+		if rt.Upstream == "" {
+			return nil, fmt.Errorf("route %v: upstream is not set", i)
+		}
+		result = append(result, rt)
+	}
+	result = append(result, &route{
+		Upstream: *upstreamAddr, TLSServerName: *upstreamTLSServerName,
+	})
+
+	for i, rt := range result {
+		if rt.Scheme == "" {
+			rt.Scheme = *upstreamScheme
+		}
+		if rt.Scheme != "http" && rt.Scheme != "https" {
+			return nil, fmt.Errorf("route %v: unknown scheme %v", i, rt.Scheme)
+		}
+		if rt.Dir == "" {
+			rt.Dir = *dumpDir
+		}
+	}
+	return result, nil
+}
+
+func (rt *route) matches(r *http.Request) bool {
+	if rt.Host != "" && !strings.EqualFold(rt.Host, r.Host) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil || !strings.EqualFold(rt.Host, host) {
+			return false
+		}
+	}
+	return strings.HasPrefix(r.URL.Path, rt.PathPrefix)
+}
+
+func (rs *ruleSet) findRoute(r *http.Request) *route {
+	for _, rt := range rs.routes {
+		if rt.matches(r) {
+			return rt
+		}
+	}
+	// The default route matches any request.
+	panic("[assertion] no route found")
+}
+
+// routeDirs returns distinct dump directories of routes.
+func routeDirs(routes []*route) []string {
+	var dirs []string
+	seen := make(map[string]bool)
+	for _, rt := range routes {
+		if !seen[rt.Dir] {
+			seen[rt.Dir] = true
+			dirs = append(dirs, rt.Dir)
+		}
+	}
+	return dirs
+}
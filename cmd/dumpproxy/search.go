@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexFileName is the file in the dump directory with a JSON line per
+// completed exchange, it's what search looks through.
+const indexFileName = "index.jsonl"
+
+var indexMu sync.Mutex
+
+type indexEntry struct {
+	ID              string      `json:"id"`
+	Started         time.Time   `json:"started"`
+	DurationMS      float64     `json:"duration_ms"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	Status          int         `json:"status"`
+	RequestSize     int64       `json:"request_size"`
+	ResponseSize    int64       `json:"response_size"`
+	Prefix          string      `json:"prefix"`
+	Faults          []string    `json:"faults,omitempty"`
+	RequestHeaders  http.Header `json:"request_headers,omitempty"`
+	ResponseHeaders http.Header `json:"response_headers,omitempty"`
+}
+
+// newIndexEntry builds the index entry of an exchange. Headers are read
+// back from the dumps, so they are redacted the same way.
+func newIndexEntry(dumpFilePrefix string, meta *exchangeMeta) *indexEntry {
+	entry := &indexEntry{
+		ID:           meta.ID,
+		Started:      meta.Started,
+		DurationMS:   meta.DurationMS,
+		Method:       meta.Method,
+		URL:          meta.URL,
+		Status:       meta.Status,
+		RequestSize:  meta.RequestSize,
+		ResponseSize: meta.ResponseSize,
+		Prefix:       dumpFilePrefix,
+		Faults:       meta.Faults,
+	}
+	_, entry.RequestHeaders, _ = readHeadersDump(
+		dumpFilePrefix + suffixReqHeaders,
+	)
+	_, entry.ResponseHeaders, _ = readHeadersDump(
+		dumpFilePrefix + suffixRespHeaders,
+	)
+	return entry
+}
+
+// indexDir returns the dump directory the exchange belongs to, which is
+// the parent of its date subdirectory if there is one.
+func indexDir(dumpFilePrefix string) string {
+	dir := path.Dir(dumpFilePrefix)
+	if ok, _ := path.Match(dateDirPattern, path.Base(dir)); ok {
+		return path.Dir(dir)
+	}
+	return dir
+}
+
+func appendIndex(dir string, entry *indexEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	f, err := os.OpenFile(
+		path.Join(dir, indexFileName), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666,
+	)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(data, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rebuildIndex writes the index of dir anew from metadata files, e.g. for
+// dumps made before the index existed.
+func rebuildIndex(dir string) error {
+	metas, err := listMeta(dir)
+	if err != nil {
+		return err
+	}
+
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	fName := path.Join(dir, indexFileName)
+	f, err := os.Create(fName + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, meta := range metas {
+		if meta.Method == "" {
+			// The exchange never completed.
+			continue
+		}
+		entry := newIndexEntry(exchangePrefix(dir, meta.ID), meta)
+		if err = enc.Encode(entry); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fName+".tmp", fName)
+}
+
+// trimIndex drops entries of deleted exchanges from the index of dir.
+func trimIndex(dir string, deleted map[string]bool) error {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+
+	fName := path.Join(dir, indexFileName)
+	in, err := os.Open(fName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closeLogError(in)
+
+	out, err := os.Create(fName + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	rd := bufio.NewReader(in)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			_ = out.Close()
+			return err
+		}
+		var entry struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(line, &entry) == nil && deleted[entry.ID] {
+			continue
+		}
+		if _, err = w.Write(line); err != nil {
+			_ = out.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fName+".tmp", fName)
+}
+
+// searchQuery selects index entries. Zero fields match anything.
+type searchQuery struct {
+	From, To time.Time
+	Method   string
+	Path     *regexp.Regexp
+	Status   string
+	Headers  []headerMatch
+}
+
+// headerMatch matches entries with a request or response header Name
+// which value contains Value.
+type headerMatch struct {
+	Name, Value string
+}
+
+var searchTimeLayouts = []string{
+	time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02",
+}
+
+func parseSearchTime(value string) (time.Time, error) {
+	for _, layout := range searchTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %v", value)
+}
+
+// parseSearchQuery parses from, to, method, path (regular expression),
+// status (404 or 5xx) and header ("Name: value") parameters.
+func parseSearchQuery(params url.Values) (*searchQuery, error) {
+	q := &searchQuery{Method: params.Get("method"), Status: params.Get("status")}
+	var err error
+	if v := params.Get("from"); v != "" {
+		if q.From, err = parseSearchTime(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := params.Get("to"); v != "" {
+		if q.To, err = parseSearchTime(v); err != nil {
+			return nil, err
+		}
+	}
+	if v := params.Get("path"); v != "" {
+		if q.Path, err = regexp.Compile(v); err != nil {
+			return nil, err
+		}
+	}
+	if q.Status != "" && !validStatusPattern(q.Status) {
+		return nil, fmt.Errorf("invalid status %v", q.Status)
+	}
+	for _, v := range params["header"] {
+		idx := strings.Index(v, ":")
+		if idx < 1 {
+			return nil, fmt.Errorf("invalid header %q, want Name: value", v)
+		}
+		q.Headers = append(q.Headers, headerMatch{
+			Name:  http.CanonicalHeaderKey(strings.TrimSpace(v[:idx])),
+			Value: strings.TrimSpace(v[idx+1:]),
+		})
+	}
+	return q, nil
+}
+
+func (q *searchQuery) match(entry *indexEntry) bool {
+	if !q.From.IsZero() && entry.Started.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && entry.Started.After(q.To) {
+		return false
+	}
+	if q.Method != "" && !strings.EqualFold(q.Method, entry.Method) {
+		return false
+	}
+	if q.Status != "" && !matchStatus(q.Status, entry.Status) {
+		return false
+	}
+	if q.Path != nil {
+		u, err := url.Parse(entry.URL)
+		if err != nil || !q.Path.MatchString(u.Path) {
+			return false
+		}
+	}
+	for _, hm := range q.Headers {
+		if !headerContains(entry.RequestHeaders, hm) &&
+			!headerContains(entry.ResponseHeaders, hm) {
+			return false
+		}
+	}
+	return true
+}
+
+func headerContains(header http.Header, hm headerMatch) bool {
+	for _, value := range header[hm.Name] {
+		if strings.Contains(value, hm.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// searchIndex calls fn for every entry of the dir index matching q, in
+// the order exchanges completed.
+func searchIndex(dir string, q *searchQuery, fn func(*indexEntry)) error {
+	f, err := os.Open(path.Join(dir, indexFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer closeLogError(f)
+
+	rd := bufio.NewReader(f)
+	for {
+		line, err := rd.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without the newline is still being written.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry := &indexEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			log.Printf("search: %v", err)
+			continue
+		}
+		if q.match(entry) {
+			fn(entry)
+		}
+	}
+}
+
+// apiSearch serves /api/search with index entries matching query
+// parameters, see parseSearchQuery.
+func (a *admin) apiSearch(w http.ResponseWriter, r *http.Request) {
+	q, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	dir, ok := a.dumpDir(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	entries := []*indexEntry{}
+	err = searchIndex(dir, q, func(entry *indexEntry) {
+		// Keep the newest ones.
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// headerFlags collects values of a repeated flag.
+type headerFlags []string
+
+func (hf *headerFlags) String() string {
+	return strings.Join(*hf, ", ")
+}
+
+func (hf *headerFlags) Set(value string) error {
+	*hf = append(*hf, value)
+	return nil
+}
+
+func searchCmd(args []string) {
+	fs := flag.NewFlagSet("search", flag.ExitOnError)
+	dir := fs.String("dir", "./", "directory with dumped traffic")
+	reindex := fs.Bool("reindex", false, "rebuild the index before search")
+	asJSON := fs.Bool("json", false, "print matching index entries as JSON")
+	queryFlags := make(map[string]*string)
+	for _, name := range []string{"from", "to", "method", "path", "status"} {
+		queryFlags[name] = fs.String(name, "", searchFlagUsage[name])
+	}
+	var headers headerFlags
+	fs.Var(&headers, "header", searchFlagUsage["header"])
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v search [flags]\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	_ = fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	params := url.Values{"header": headers}
+	for name, value := range queryFlags {
+		params.Set(name, *value)
+	}
+
+	q, err := parseSearchQuery(params)
+	if err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		os.Exit(2)
+	}
+	if *reindex {
+		if err = rebuildIndex(*dir); err != nil {
+			panic(err)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	err = searchIndex(*dir, q, func(entry *indexEntry) {
+		if *asJSON {
+			_ = enc.Encode(entry)
+			return
+		}
+		fmt.Printf(
+			"%v\t%v\t%v\t%v\t%.1fms\t%v\n",
+			entry.Started.Format("2006-01-02 15:04:05.000"), entry.Status,
+			entry.Method, entry.URL, entry.DurationMS, entry.Prefix,
+		)
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+var searchFlagUsage = map[string]string{
+	"from": "exchanges started at or after this time, RFC 3339 or " +
+		"2006-01-02 15:04:05 in local time",
+	"to":     "exchanges started at or before this time",
+	"method": "request method",
+	"path":   "regular expression matching the URL path",
+	"status": "response status code like 500 or class like 5xx",
+	"header": "request or response header containing a value, " +
+		"\"Name: value\", may be repeated",
+}
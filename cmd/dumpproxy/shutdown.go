@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shutdownTimeout = flag.Duration(
+	"shutdown-timeout", 30*time.Second,
+	"how long to wait on SIGINT or SIGTERM for active exchanges to finish, "+
+		"dumps of ones still running are discarded",
+)
+
+// activeDumps are prefixes of exchanges being dumped.
+var activeDumps = struct {
+	sync.Mutex
+	prefixes map[string]bool
+}{prefixes: make(map[string]bool)}
+
+// draining is set to 1 once the proxy is shutting down.
+var draining int32
+
+// upstreamCtx is canceled once shutdown stops waiting, so upstream
+// requests still running are dropped.
+var upstreamCtx, cancelUpstream = context.WithCancel(context.Background())
+
+func shuttingDown() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
+
+func trackDump(prefix string) {
+	activeDumps.Lock()
+	activeDumps.prefixes[prefix] = true
+	activeDumps.Unlock()
+}
+
+// untrackDump is called once all files of the exchange are written.
+func untrackDump(prefix string) {
+	if prefix == "" {
+		return
+	}
+	activeDumps.Lock()
+	delete(activeDumps.prefixes, prefix)
+	activeDumps.Unlock()
+}
+
+// tunnels are CONNECT connections being relayed. http.Server doesn't
+// track hijacked connections, servers handling intercepted ones are shut
+// down along with the proxy.
+var tunnels = struct {
+	sync.Mutex
+	active  int
+	servers map[*http.Server]bool
+}{servers: make(map[*http.Server]bool)}
+
+// trackTunnel is called when a tunnel starts, srv is nil unless the
+// tunnel is intercepted.
+func trackTunnel(srv *http.Server) {
+	tunnels.Lock()
+	tunnels.active++
+	if srv != nil {
+		tunnels.servers[srv] = true
+	}
+	tunnels.Unlock()
+}
+
+func untrackTunnel(srv *http.Server) {
+	tunnels.Lock()
+	tunnels.active--
+	delete(tunnels.servers, srv)
+	tunnels.Unlock()
+}
+
+func activeTunnels() (int, []*http.Server) {
+	tunnels.Lock()
+	defer tunnels.Unlock()
+	servers := make([]*http.Server, 0, len(tunnels.servers))
+	for srv := range tunnels.servers {
+		servers = append(servers, srv)
+	}
+	return tunnels.active, servers
+}
+
+func activeDumpPrefixes() []string {
+	activeDumps.Lock()
+	defer activeDumps.Unlock()
+	prefixes := make([]string, 0, len(activeDumps.prefixes))
+	for prefix := range activeDumps.prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes
+}
+
+// dumpFile syncs dumps closed during shutdown, so exchanges finished
+// while draining are on disk before the proxy exits.
+type dumpFile struct {
+	*os.File
+}
+
+func (df dumpFile) Close() error {
+	if shuttingDown() {
+		if err := df.Sync(); err != nil {
+			log.Print(err)
+		}
+	}
+	return df.File.Close()
+}
+
+// serve runs srv until SIGINT or SIGTERM and shuts it down gracefully.
+// SIGHUP reloads the config.
+func serve(srv *http.Server) {
+	errs := make(chan error, 1)
+	go func() {
+		if *tlsCert != "" {
+			errs <- srv.ListenAndServeTLS(*tlsCert, *tlsKey)
+		} else {
+			errs <- srv.ListenAndServe()
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	for {
+		select {
+		case err := <-errs:
+			panic(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				reloadRules()
+				continue
+			}
+			log.Printf("%v, shutting down", sig)
+			shutdown(srv)
+			return
+		}
+	}
+}
+
+// shutdown stops accepting connections and waits for active exchanges
+// and tunnels for -shutdown-timeout. Intercepted tunnels are closed once
+// idle, dumps in progress are waited for too. Upstream
+// requests don't end with client connections and are canceled after the
+// timeout, dumps that didn't finish in time are discarded.
+func shutdown(srv *http.Server) {
+	atomic.StoreInt32(&draining, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("shutdown: %v", err)
+	}
+	_, servers := activeTunnels()
+	var wg sync.WaitGroup
+	for _, tunnelSrv := range servers {
+		wg.Add(1)
+		go func(tunnelSrv *http.Server) {
+			defer wg.Done()
+			if err := tunnelSrv.Shutdown(ctx); err != nil {
+				log.Printf("shutdown: %v", err)
+			}
+		}(tunnelSrv)
+	}
+	wg.Wait()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for running() && ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-ticker.C:
+		}
+	}
+
+	cancelUpstream()
+	for _, prefix := range activeDumpPrefixes() {
+		dir, id := path.Split(prefix)
+		discardExchange(dir, id, "unfinished on shutdown")
+	}
+	if har != nil {
+		if err := har.flush(); err != nil {
+			log.Printf("har: %v", err)
+		}
+	}
+}
+
+// running tells if any tunnel or dump is not finished yet.
+func running() bool {
+	active, _ := activeTunnels()
+	return active > 0 || len(activeDumpPrefixes()) > 0
+}
@@ -0,0 +1,186 @@
+package dumpproxy
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// HeaderDecodedFrom is added to the request or response headers dump if
+// the body dump was decoded, its value is the original Content-Encoding.
+const HeaderDecodedFrom = "X-Dumpproxy-Decoded-From"
+
+// BodyNotRedactable replaces body dumps that have to be redacted but can't
+// be decoded.
+const BodyNotRedactable = "[body not redactable]"
+
+type decoderFunc func(r io.Reader) (io.ReadCloser, error)
+
+// contentDecoders maps Content-Encoding tokens to decoders used for dump
+// files.
+var contentDecoders = map[string]decoderFunc{
+	"gzip":    newGzipReader,
+	"x-gzip":  newGzipReader,
+	"deflate": newDeflateReader,
+	"zstd":    newZstdReader,
+	"br":      newBrotliReader,
+}
+
+func newGzipReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// newDeflateReader reads HTTP deflate which is zlib wrapped, raw deflate
+// some servers send instead is read as well.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	hdr, err := br.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(hdr) == 2 && hdr[0]&0x0f == 8 &&
+		(uint16(hdr[0])<<8|uint16(hdr[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+	return flate.NewReader(br), nil
+}
+
+func newZstdReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+func newBrotliReader(r io.Reader) (io.ReadCloser, error) {
+	return ioutil.NopCloser(brotli.NewReader(r)), nil
+}
+
+// CanDecode reports whether every encoding listed in the Content-Encoding
+// header value has a decoder, so FileSink can store the body decoded.
+func CanDecode(contentEncoding string) bool {
+	encodings := splitEncodings(contentEncoding)
+	if len(encodings) == 0 {
+		return false
+	}
+	for _, enc := range encodings {
+		if _, ok := contentDecoders[enc]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func splitEncodings(contentEncoding string) []string {
+	var encodings []string
+	for _, enc := range strings.Split(contentEncoding, ",") {
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		if enc != "" && enc != "identity" {
+			encodings = append(encodings, enc)
+		}
+	}
+	return encodings
+}
+
+// decodingWriter stores a body decoded in dst on Close. The original
+// bytes are spooled to a temporary file, so they are stored as received if
+// decoding fails. If notRedactable is set, BodyNotRedactable is written
+// to it instead, bypassing redaction of dst.
+type decodingWriter struct {
+	encodings     []string
+	dst           io.Writer
+	notRedactable io.Writer
+	spool         *os.File
+	// decoded is called once the body is stored decoded.
+	decoded func()
+}
+
+// newDecodingWriter returns a writer that stores the body decoded from
+// contentEncoding in dst, see CanDecode.
+func newDecodingWriter(
+	contentEncoding string,
+	dst io.Writer,
+	notRedactable io.Writer,
+	decoded func(),
+) (io.WriteCloser, error) {
+	spool, err := ioutil.TempFile("", "dumpproxy-")
+	if err != nil {
+		return nil, err
+	}
+	return &decodingWriter{
+		encodings:     splitEncodings(contentEncoding),
+		dst:           dst,
+		notRedactable: notRedactable,
+		spool:         spool,
+		decoded:       decoded,
+	}, nil
+}
+
+func decodeTo(dst io.Writer, src io.Reader, encodings []string) error {
+	// Encodings are listed in the order they were applied.
+	var r io.Reader = src
+	for i := len(encodings) - 1; i >= 0; i-- {
+		newDecoder, ok := contentDecoders[encodings[i]]
+		if !ok {
+			return fmt.Errorf("unknown content encoding %v", encodings[i])
+		}
+		rc, err := newDecoder(r)
+		if err != nil {
+			return err
+		}
+		defer func() { _ = rc.Close() }()
+		r = rc
+	}
+	_, err := io.Copy(dst, r)
+	return err
+}
+
+func (dw *decodingWriter) Write(p []byte) (int, error) {
+	return dw.spool.Write(p)
+}
+
+func (dw *decodingWriter) Close() error {
+	defer func() {
+		_ = dw.spool.Close()
+		_ = os.Remove(dw.spool.Name())
+	}()
+
+	// A body that fails to decode halfway is checked before anything is
+	// stored, dst gets either the whole decoded body or the original one.
+	rewind := func() error {
+		_, err := dw.spool.Seek(0, io.SeekStart)
+		return err
+	}
+	if err := rewind(); err != nil {
+		return err
+	}
+	if decodeTo(ioutil.Discard, dw.spool, dw.encodings) != nil {
+		if dw.notRedactable != nil {
+			_, err := io.WriteString(dw.notRedactable, BodyNotRedactable)
+			return err
+		}
+		if err := rewind(); err != nil {
+			return err
+		}
+		_, err := io.Copy(dw.dst, dw.spool)
+		return err
+	}
+	if err := rewind(); err != nil {
+		return err
+	}
+	if err := decodeTo(dw.dst, dw.spool, dw.encodings); err != nil {
+		return err
+	}
+	dw.decoded()
+	return nil
+}
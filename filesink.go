@@ -0,0 +1,467 @@
+package dumpproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Suffixes of dump files of an exchange. Only exchanges that switched
+// protocols have the WebSocket frames file.
+const (
+	SuffixRequestHeaders  = ".request_headers"
+	SuffixRequestBody     = ".request_body"
+	SuffixResponseHeaders = ".response_headers"
+	SuffixResponseBody    = ".response_body"
+	SuffixWSFrames        = ".ws_frames"
+)
+
+// DateDirFormat names daily subdirectories of FileSink.DateDirs, prefixes
+// of exchanges start with the same date.
+const DateDirFormat = "2006-01-02"
+
+var fileSuffixes = []string{
+	SuffixRequestHeaders, SuffixRequestBody,
+	SuffixResponseHeaders, SuffixResponseBody, SuffixWSFrames,
+}
+
+// ReservePrefix returns a new dump file prefix in dir for an exchange
+// started at t, e.g. dir/2006-01-02-15-04-05-0. The prefix is reserved by
+// creating its empty request headers file.
+func ReservePrefix(dir string, t time.Time) (string, error) {
+	datePrefix := path.Join(dir, t.Format("2006-01-02-15-04-05-"))
+	for idx := 0; ; idx++ {
+		prefix := datePrefix + strconv.Itoa(idx)
+		f, err := os.OpenFile(
+			prefix+SuffixRequestHeaders, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666,
+		)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return prefix, f.Close()
+	}
+}
+
+// Redactor masks sensitive data in dumps, proxied traffic is never
+// changed.
+type Redactor interface {
+	// RedactHeader returns the value of the header as it should be dumped.
+	RedactHeader(name, value string) string
+	// RedactQuery returns the raw URL query as it should be dumped.
+	RedactQuery(rawQuery string) string
+	// RedactBody returns a writer storing the redacted body in w or nil if
+	// bodies are dumped as they are. The writer gets decoded bodies and
+	// is closed once the body is complete.
+	RedactBody(w io.Writer) io.WriteCloser
+}
+
+// FileSink dumps every exchange to files in Dir, see ReservePrefix and
+// Suffix* constants. Headers files have the request or status line
+// followed by header lines and trailer lines if there are trailers,
+// request headers are dumped as sent upstream. Bodies are dumped as
+// received unless Decode is set, WebSocket frames are dumped as JSON
+// lines.
+type FileSink struct {
+	Dir string
+	// DateDirs puts dumps in daily subdirectories of Dir, see
+	// DateDirFormat.
+	DateDirs bool
+	// Decode stores compressed response bodies decoded if CanDecode, the
+	// original encoding is recorded as HeaderDecodedFrom. Bodies that
+	// fail to decode are stored as received without it.
+	Decode bool
+	// Redactor masks sensitive data in dumps if set. Compressed request
+	// and response bodies it redacts are decoded regardless of Decode,
+	// ones that fail to decode are replaced with BodyNotRedactable.
+	Redactor Redactor
+	// Create creates dump files, os.Create is used if nil.
+	Create func(name string) (io.WriteCloser, error)
+	// Incomplete is called with the prefix of a failed exchange instead of
+	// removing its dump files, e.g. to move them aside.
+	Incomplete func(prefix string, err error)
+}
+
+// WriteExchange dumps ex. Files of an exchange that failed to be written
+// are removed.
+func (fs *FileSink) WriteExchange(ctx context.Context, ex *Exchange) error {
+	return StreamExchange(ctx, fs, ex)
+}
+
+// OpenExchange calls Open.
+func (fs *FileSink) OpenExchange(
+	_ context.Context,
+	ex *Exchange,
+) (ExchangeWriter, error) {
+	return fs.Open(ex)
+}
+
+// Open reserves a prefix for the exchange and dumps its request headers.
+func (fs *FileSink) Open(ex *Exchange) (*FileExchange, error) {
+	dir := fs.Dir
+	if fs.DateDirs {
+		dir = path.Join(dir, ex.Started.Format(DateDirFormat))
+		if err := os.MkdirAll(dir, 0777); err != nil {
+			return nil, err
+		}
+	}
+	prefix, err := ReservePrefix(dir, ex.Started)
+	if err != nil {
+		return nil, err
+	}
+
+	fx := &FileExchange{Prefix: prefix, fs: fs}
+	r := ex.Request
+	requestURI := r.RequestURI
+	if requestURI == "" {
+		requestURI = r.URL.RequestURI()
+	}
+	if i := strings.Index(requestURI, "?"); i != -1 && fs.Redactor != nil {
+		requestURI = requestURI[:i+1] + fs.Redactor.RedactQuery(requestURI[i+1:])
+	}
+	header := r.Header
+	if ex.UpstreamRequest != nil {
+		header = ex.UpstreamRequest.Header
+	}
+	fx.reqHeaders, err = fx.writeHeaders(
+		SuffixRequestHeaders,
+		fmt.Sprintf("%v %v %v", r.Method, requestURI, r.Proto),
+		header, r.Trailer,
+	)
+	if err == nil {
+		fx.reqBody, err = fx.createBody(
+			SuffixRequestBody, header.Get("Content-Encoding"),
+			&fx.reqDecodedFrom,
+		)
+	}
+	if err != nil {
+		fx.Discard()
+		return nil, err
+	}
+	return fx, nil
+}
+
+// FileExchange is an exchange being dumped by FileSink.
+type FileExchange struct {
+	// Prefix is the dump file prefix of the exchange.
+	Prefix string
+
+	fs          *FileSink
+	reqHeaders  io.WriteCloser
+	reqBody     io.WriteCloser
+	respHeaders io.WriteCloser
+	respBody    io.WriteCloser
+
+	// reqDecodedFrom and respDecodedFrom are the Content-Encoding body
+	// dumps were decoded from, they are known once bodies are closed.
+	reqDecodedFrom  string
+	respDecodedFrom string
+
+	framesMu sync.Mutex
+	frames   io.WriteCloser
+}
+
+// RequestBody returns the request body dump.
+func (fx *FileExchange) RequestBody() io.Writer {
+	return fx.reqBody
+}
+
+// WriteResponse dumps response headers and returns the response body
+// dump.
+func (fx *FileExchange) WriteResponse(resp *http.Response) (io.Writer, error) {
+	var err error
+	fx.respHeaders, err = fx.writeHeaders(
+		SuffixResponseHeaders, resp.Status, resp.Header, resp.Trailer,
+	)
+	if err == nil {
+		fx.respBody, err = fx.createBody(
+			SuffixResponseBody, resp.Header.Get("Content-Encoding"),
+			&fx.respDecodedFrom,
+		)
+	}
+	if err == nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		// Traffic after the switch goes to the frames dump.
+		fx.frames, err = fx.create(SuffixWSFrames)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return fx.respBody, nil
+}
+
+type wsFrame struct {
+	Time            string `json:"time"`
+	Direction       string `json:"direction"`
+	Opcode          string `json:"opcode"`
+	Fin             bool   `json:"fin"`
+	Length          uint64 `json:"length"`
+	Payload         string `json:"payload"`
+	PayloadEncoding string `json:"payload_encoding,omitempty"`
+	Truncated       bool   `json:"truncated,omitempty"`
+}
+
+var wsOpcodes = map[byte]string{
+	0x0: "continuation",
+	0x1: "text",
+	0x2: "binary",
+	0x8: "close",
+	0x9: "ping",
+	0xa: "pong",
+}
+
+// WriteFrame dumps a WebSocket frame as a JSON line, its payload is
+// redacted like bodies.
+func (fx *FileExchange) WriteFrame(f *Frame) error {
+	opcode, ok := wsOpcodes[f.Opcode]
+	if !ok {
+		opcode = fmt.Sprintf("%#x", f.Opcode)
+	}
+	frame := wsFrame{
+		Time:      f.Time.Format(time.RFC3339Nano),
+		Direction: "server",
+		Opcode:    opcode,
+		Fin:       f.Fin,
+		Length:    f.Length,
+		Truncated: uint64(len(f.Payload)) < f.Length,
+	}
+	if f.FromClient {
+		frame.Direction = "client"
+	}
+	payload := f.Payload
+	var buf bytes.Buffer
+	var rw io.WriteCloser
+	if fx.fs.Redactor != nil {
+		rw = fx.fs.Redactor.RedactBody(&buf)
+	}
+	if rw != nil {
+		_, err := rw.Write(payload)
+		if closeErr := rw.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		payload = buf.Bytes()
+	}
+	if utf8.Valid(payload) {
+		frame.Payload = string(payload)
+	} else {
+		frame.Payload = base64.StdEncoding.EncodeToString(payload)
+		frame.PayloadEncoding = "base64"
+	}
+
+	data, err := json.Marshal(frame)
+	if err != nil {
+		return err
+	}
+
+	fx.framesMu.Lock()
+	defer fx.framesMu.Unlock()
+	if fx.frames == nil {
+		return nil
+	}
+	_, err = fx.frames.Write(append(data, '\n'))
+	return err
+}
+
+// Close appends trailers to headers dumps and closes all files. Dumps of
+// a failed exchange are removed or handed to FileSink.Incomplete.
+func (fx *FileExchange) Close(ex *Exchange) error {
+	// Bodies go first, redaction and decoding write on close.
+	err := closeAll(&fx.reqBody, &fx.respBody)
+	if err == nil && ex.Err == nil {
+		err = fx.writeHeaderLines(fx.reqHeaders, ex.Request.Trailer)
+		if err == nil {
+			err = writeDecodedFrom(fx.reqHeaders, fx.reqDecodedFrom)
+		}
+		if err == nil && ex.Response != nil && fx.respHeaders != nil {
+			err = fx.writeHeaderLines(fx.respHeaders, ex.Response.Trailer)
+			if err == nil {
+				err = writeDecodedFrom(fx.respHeaders, fx.respDecodedFrom)
+			}
+		}
+	}
+	if closeErr := fx.closeFiles(); err == nil {
+		err = closeErr
+	}
+
+	failure := ex.Err
+	if failure == nil {
+		failure = err
+	}
+	if failure != nil {
+		if fx.fs.Incomplete != nil {
+			fx.fs.Incomplete(fx.Prefix, failure)
+		} else {
+			fx.remove()
+		}
+	}
+	return err
+}
+
+// Discard closes and removes dump files of the exchange, e.g. once it
+// turns out the exchange shouldn't be kept. Body writers it returned must
+// not be written afterwards.
+func (fx *FileExchange) Discard() {
+	_ = fx.closeFiles()
+	fx.remove()
+}
+
+func (fx *FileExchange) closeFiles() error {
+	fx.framesMu.Lock()
+	defer fx.framesMu.Unlock()
+	return closeAll(
+		&fx.reqBody, &fx.respBody, &fx.reqHeaders, &fx.respHeaders, &fx.frames,
+	)
+}
+
+// closeAll closes files in order and forgets them, closed ones are nil.
+func closeAll(files ...*io.WriteCloser) error {
+	var err error
+	for _, f := range files {
+		if *f == nil {
+			continue
+		}
+		if closeErr := (*f).Close(); err == nil {
+			err = closeErr
+		}
+		*f = nil
+	}
+	return err
+}
+
+func (fx *FileExchange) remove() {
+	for _, suffix := range fileSuffixes {
+		_ = os.Remove(fx.Prefix + suffix)
+	}
+}
+
+func (fx *FileExchange) create(suffix string) (io.WriteCloser, error) {
+	if fx.fs.Create != nil {
+		return fx.fs.Create(fx.Prefix + suffix)
+	}
+	return os.Create(fx.Prefix + suffix)
+}
+
+// createBody creates a body dump. A body compressed with contentEncoding
+// is decoded if FileSink.Decode is set and CanDecode, or if it's redacted,
+// decodedFrom is set to the encoding once it's decoded.
+func (fx *FileExchange) createBody(
+	suffix string,
+	contentEncoding string,
+	decodedFrom *string,
+) (io.WriteCloser, error) {
+	f, err := fx.create(suffix)
+	if err != nil {
+		return nil, err
+	}
+	body := f
+	var redact io.WriteCloser
+	if fx.fs.Redactor != nil {
+		redact = fx.fs.Redactor.RedactBody(f)
+	}
+	if redact != nil {
+		body = &closeBoth{redact, f}
+	}
+
+	if len(splitEncodings(contentEncoding)) == 0 ||
+		(redact == nil && !(fx.fs.Decode && CanDecode(contentEncoding))) {
+		return body, nil
+	}
+	// Redaction rules can't match compressed bytes, bodies that can't be
+	// decoded aren't dumped at all then.
+	var notRedactable io.Writer
+	if redact != nil {
+		notRedactable = f
+	}
+	dw, err := newDecodingWriter(contentEncoding, body, notRedactable, func() {
+		*decodedFrom = contentEncoding
+	})
+	if err != nil {
+		_ = body.Close()
+		return nil, err
+	}
+	return &closeBoth{dw, body}, nil
+}
+
+// writeDecodedFrom records the encoding a body dump was decoded from in
+// its headers dump.
+func writeDecodedFrom(w io.Writer, decodedFrom string) error {
+	if decodedFrom == "" {
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "%v: %v\n", HeaderDecodedFrom, decodedFrom)
+	return err
+}
+
+// writeHeaders creates a headers dump with the first line, an
+// announcement of trailers and header lines.
+func (fx *FileExchange) writeHeaders(
+	suffix string,
+	firstLine string,
+	header, trailer http.Header,
+) (io.WriteCloser, error) {
+	f, err := fx.create(suffix)
+	if err != nil {
+		return nil, err
+	}
+	_, err = fmt.Fprintf(f, "%v\n", firstLine)
+	if err == nil && len(trailer) > 0 {
+		_, err = fmt.Fprintf(
+			f, "Trailer: %v\n", strings.Join(TrailerNames(trailer), ", "),
+		)
+	}
+	if err == nil {
+		err = fx.writeHeaderLines(f, header)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// writeHeaderLines dumps redacted headers as "Name: value" lines.
+func (fx *FileExchange) writeHeaderLines(
+	w io.Writer,
+	header http.Header,
+) error {
+	for name, values := range header {
+		for _, value := range values {
+			if fx.fs.Redactor != nil {
+				value = fx.fs.Redactor.RedactHeader(name, value)
+			}
+			if _, err := fmt.Fprintf(w, "%v: %v\n", name, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// closeBoth is a writer wrapping next which is closed after the writer.
+type closeBoth struct {
+	io.WriteCloser
+	next io.Closer
+}
+
+func (cb *closeBoth) Close() error {
+	err := cb.WriteCloser.Close()
+	if closeErr := cb.next.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
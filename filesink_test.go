@@ -0,0 +1,472 @@
+package dumpproxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// proxyToFiles proxies a GET request to upstream through a Proxy writing
+// to fs and returns the client response body.
+func proxyToFiles(
+	t *testing.T,
+	fs *FileSink,
+	upstream http.HandlerFunc,
+) []byte {
+	ps, stop := newTestProxy(t, upstream, &Proxy{Sink: fs})
+	defer stop()
+
+	req, err := http.NewRequest(http.MethodGet, ps.URL+"/file", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "secret")
+	// Keep compressed bodies as sent.
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// dumpFile returns the content of the only dump with suffix in dir.
+func dumpFile(t *testing.T, dir, suffix string) string {
+	names, err := filepath.Glob(filepath.Join(dir, "*"+suffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 1 {
+		t.Fatalf("got %v %v dumps", len(names), suffix)
+	}
+	data, err := ioutil.ReadFile(names[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestFileSink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	proxyToFiles(
+		t, &FileSink{Dir: dir},
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Upstream", "1")
+			_, _ = w.Write([]byte("response"))
+		},
+	)
+
+	reqHeaders := dumpFile(t, dir, SuffixRequestHeaders)
+	if !strings.HasPrefix(reqHeaders, "GET /file HTTP/1.1\n") {
+		t.Errorf("request headers dump:\n%v", reqHeaders)
+	}
+	if !strings.Contains(reqHeaders, "Authorization: secret\n") {
+		t.Errorf("request headers dump:\n%v", reqHeaders)
+	}
+	respHeaders := dumpFile(t, dir, SuffixResponseHeaders)
+	if !strings.HasPrefix(respHeaders, "200 OK\n") ||
+		!strings.Contains(respHeaders, "X-Upstream: 1\n") {
+		t.Errorf("response headers dump:\n%v", respHeaders)
+	}
+	if body := dumpFile(t, dir, SuffixRequestBody); body != "" {
+		t.Errorf("request body dump = %q", body)
+	}
+	if body := dumpFile(t, dir, SuffixResponseBody); body != "response" {
+		t.Errorf("response body dump = %q", body)
+	}
+}
+
+// pack returns data compressed by newWriter.
+func pack(
+	data string,
+	newWriter func(w io.Writer) (io.WriteCloser, error),
+) []byte {
+	var buf bytes.Buffer
+	w, err := newWriter(&buf)
+	if err != nil {
+		panic(err)
+	}
+	_, _ = w.Write([]byte(data))
+	_ = w.Close()
+	return buf.Bytes()
+}
+
+func TestFileSinkDecode(t *testing.T) {
+	testCases := []struct {
+		name     string
+		encoding string
+		body     []byte
+		// dump is empty if the body is dumped as received.
+		dump string
+	}{
+		{
+			name:     "gzip",
+			encoding: "gzip",
+			body: pack("decoded", func(w io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriter(w), nil
+			}),
+			dump: "decoded",
+		},
+		{
+			name:     "zlib deflate",
+			encoding: "deflate",
+			body: pack("decoded", func(w io.Writer) (io.WriteCloser, error) {
+				return zlib.NewWriter(w), nil
+			}),
+			dump: "decoded",
+		},
+		{
+			name:     "raw deflate",
+			encoding: "deflate",
+			body: pack("decoded", func(w io.Writer) (io.WriteCloser, error) {
+				return flate.NewWriter(w, flate.DefaultCompression)
+			}),
+			dump: "decoded",
+		},
+		{
+			name:     "zstd",
+			encoding: "zstd",
+			body: pack("decoded", func(w io.Writer) (io.WriteCloser, error) {
+				return zstd.NewWriter(w)
+			}),
+			dump: "decoded",
+		},
+		{
+			name:     "brotli",
+			encoding: "br",
+			body: pack("decoded", func(w io.Writer) (io.WriteCloser, error) {
+				return brotli.NewWriter(w), nil
+			}),
+			dump: "decoded",
+		},
+		{
+			name:     "broken gzip",
+			encoding: "gzip",
+			body:     []byte("not gzip at all"),
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dumpproxy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.RemoveAll(dir) }()
+
+			body := proxyToFiles(
+				t, &FileSink{Dir: dir, Decode: true},
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Encoding", tc.encoding)
+					_, _ = w.Write(tc.body)
+				},
+			)
+
+			if !bytes.Equal(body, tc.body) {
+				t.Errorf("client got a changed body %q", body)
+			}
+			want := tc.dump
+			if want == "" {
+				want = string(tc.body)
+			}
+			dump := dumpFile(t, dir, SuffixResponseBody)
+			if dump != want {
+				t.Errorf("response body dump = %q, want %q", dump, want)
+			}
+			respHeaders := dumpFile(t, dir, SuffixResponseHeaders)
+			decodedFrom := HeaderDecodedFrom + ": " + tc.encoding + "\n"
+			if strings.Contains(respHeaders, decodedFrom) != (tc.dump != "") {
+				t.Errorf("response headers dump:\n%v", respHeaders)
+			}
+		})
+	}
+}
+
+// upperRedactor masks Authorization headers and upper-cases queries and
+// bodies.
+type upperRedactor struct{}
+
+func (upperRedactor) RedactHeader(name, value string) string {
+	if name == "Authorization" {
+		return "REDACTED"
+	}
+	return value
+}
+
+func (upperRedactor) RedactQuery(rawQuery string) string {
+	return strings.ToUpper(rawQuery)
+}
+
+func (upperRedactor) RedactBody(w io.Writer) io.WriteCloser {
+	return &upperWriter{w}
+}
+
+type upperWriter struct {
+	w io.Writer
+}
+
+func (uw *upperWriter) Write(p []byte) (int, error) {
+	if _, err := uw.w.Write(bytes.ToUpper(p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (uw *upperWriter) Close() error { return nil }
+
+func TestFileSinkRedactor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	body := proxyToFiles(
+		t, &FileSink{Dir: dir, Redactor: upperRedactor{}},
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("response"))
+		},
+	)
+
+	if string(body) != "response" {
+		t.Errorf("client got a changed body %q", body)
+	}
+	reqHeaders := dumpFile(t, dir, SuffixRequestHeaders)
+	if !strings.Contains(reqHeaders, "Authorization: REDACTED\n") {
+		t.Errorf("request headers dump:\n%v", reqHeaders)
+	}
+	if dump := dumpFile(t, dir, SuffixResponseBody); dump != "RESPONSE" {
+		t.Errorf("response body dump = %q", dump)
+	}
+}
+
+func TestFileSinkRedactCompressed(t *testing.T) {
+	gzipped := pack("decoded", func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	})
+	testCases := []struct {
+		name     string
+		encoding string
+		body     []byte
+		dump     string
+		// decoded is set if the headers dump records the encoding.
+		decoded bool
+	}{
+		{
+			name:     "gzip",
+			encoding: "gzip",
+			body:     gzipped,
+			dump:     "DECODED",
+			decoded:  true,
+		},
+		{
+			name:     "broken gzip",
+			encoding: "gzip",
+			body:     []byte("not gzip at all"),
+			dump:     BodyNotRedactable,
+		},
+		{
+			name:     "unknown encoding",
+			encoding: "compress",
+			body:     []byte("compressed"),
+			dump:     BodyNotRedactable,
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dumpproxy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.RemoveAll(dir) }()
+
+			// Redacted bodies are decoded even if Decode is not set.
+			body := proxyToFiles(
+				t, &FileSink{Dir: dir, Redactor: upperRedactor{}},
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Encoding", tc.encoding)
+					_, _ = w.Write(tc.body)
+				},
+			)
+
+			if !bytes.Equal(body, tc.body) {
+				t.Errorf("client got a changed body %q", body)
+			}
+			dump := dumpFile(t, dir, SuffixResponseBody)
+			if dump != tc.dump {
+				t.Errorf("response body dump = %q, want %q", dump, tc.dump)
+			}
+			respHeaders := dumpFile(t, dir, SuffixResponseHeaders)
+			decodedFrom := HeaderDecodedFrom + ": " + tc.encoding + "\n"
+			if strings.Contains(respHeaders, decodedFrom) != tc.decoded {
+				t.Errorf("response headers dump:\n%v", respHeaders)
+			}
+		})
+	}
+}
+
+func TestFileSinkRedactRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	var got []byte
+	ps, stop := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		got, _ = ioutil.ReadAll(r.Body)
+	}, &Proxy{Sink: &FileSink{Dir: dir, Redactor: upperRedactor{}}})
+	sent := pack("upload", func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriter(w), nil
+	})
+	req, err := http.NewRequest(
+		http.MethodPost, ps.URL+"/upload?token=secret", bytes.NewReader(sent),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	stop()
+
+	if !bytes.Equal(got, sent) {
+		t.Errorf("upstream got a changed body %q", got)
+	}
+	reqHeaders := dumpFile(t, dir, SuffixRequestHeaders)
+	if !strings.HasPrefix(reqHeaders, "POST /upload?TOKEN=SECRET HTTP/1.1\n") ||
+		!strings.Contains(reqHeaders, HeaderDecodedFrom+": gzip\n") {
+		t.Errorf("request headers dump:\n%v", reqHeaders)
+	}
+	if dump := dumpFile(t, dir, SuffixRequestBody); dump != "UPLOAD" {
+		t.Errorf("request body dump = %q", dump)
+	}
+}
+
+// headerRedactor only redacts headers and queries.
+type headerRedactor struct {
+	upperRedactor
+}
+
+func (headerRedactor) RedactBody(io.Writer) io.WriteCloser {
+	return nil
+}
+
+func TestFileSinkRedactFrames(t *testing.T) {
+	testCases := []struct {
+		name     string
+		redactor Redactor
+		want     string
+	}{
+		{name: "body rules", redactor: upperRedactor{}, want: "HELLO"},
+		{name: "no body rules", redactor: headerRedactor{}, want: "hello"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "dumpproxy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer func() { _ = os.RemoveAll(dir) }()
+
+			fs := &FileSink{Dir: dir, Redactor: tc.redactor}
+			ex := &Exchange{
+				Started: time.Now(),
+				Request: httptest.NewRequest(http.MethodGet, "/ws", nil),
+				Response: &http.Response{
+					Status:     "101 Switching Protocols",
+					StatusCode: http.StatusSwitchingProtocols,
+					Header:     make(http.Header),
+				},
+			}
+			fx, err := fs.Open(ex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = fx.WriteResponse(ex.Response); err != nil {
+				t.Fatal(err)
+			}
+			err = fx.WriteFrame(&Frame{
+				Opcode: 1, Fin: true, Length: 5, Payload: []byte("hello"),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = fx.Close(ex); err != nil {
+				t.Fatal(err)
+			}
+
+			frames := dumpFile(t, dir, SuffixWSFrames)
+			if !strings.Contains(frames, `"payload":"`+tc.want+`"`) {
+				t.Errorf("frames dump:\n%v", frames)
+			}
+		})
+	}
+}
+
+func TestFileSinkFailedExchange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dumpproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(dir) }()
+
+	var incomplete string
+	fs := &FileSink{
+		Dir:        dir,
+		Incomplete: func(prefix string, err error) { incomplete = prefix },
+	}
+	finished := make(chan struct{}, 1)
+	ps, stop := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		_, _ = w.Write([]byte("short"))
+		// Closes the connection before the whole body is sent.
+		panic(http.ErrAbortHandler)
+	}, &Proxy{Sink: fs, Finished: func(*Exchange) { finished <- struct{}{} }})
+	defer stop()
+
+	get := func() {
+		if resp, err := http.Get(ps.URL); err == nil {
+			_, _ = ioutil.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+		}
+		<-finished
+	}
+
+	get()
+	if !strings.HasPrefix(incomplete, dir) {
+		t.Errorf("incomplete prefix = %q", incomplete)
+	}
+
+	fs.Incomplete = nil
+	get()
+	names, _ := filepath.Glob(filepath.Join(dir, "*"+SuffixRequestHeaders))
+	if len(names) != 1 {
+		t.Errorf("failed exchange dumps not removed: %v", names)
+	}
+}
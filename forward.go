@@ -0,0 +1,111 @@
+package dumpproxy
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// hopHeaders are meaningful only for a single connection and must not be
+// forwarded, see RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopHeaders deletes hop-by-hop headers and headers listed in
+// Connection from header. Protocol upgrades like WebSocket are kept:
+// Connection: Upgrade and Upgrade survive, so does TE: trailers.
+func RemoveHopHeaders(header http.Header) {
+	upgrade := ""
+	for _, value := range header["Connection"] {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if strings.EqualFold(name, "Upgrade") {
+				upgrade = header.Get("Upgrade")
+			}
+			if name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	trailers := false
+	for _, value := range header["Te"] {
+		for _, te := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(te), "trailers") {
+				trailers = true
+			}
+		}
+	}
+
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+
+	if upgrade != "" {
+		header.Set("Connection", "Upgrade")
+		header.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		header.Set("Te", "trailers")
+	}
+}
+
+// AddForwardedHeaders appends the client address of r to
+// X-Forwarded-For in header and sets X-Forwarded-Proto unless a previous
+// proxy did.
+func AddForwardedHeaders(header http.Header, r *http.Request) {
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := header["X-Forwarded-For"]; len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		header.Set("X-Forwarded-For", ip)
+	}
+	if header.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		header.Set("X-Forwarded-Proto", proto)
+	}
+}
+
+// AnnounceTrailers declares trailers of resp in the header of w and
+// returns their number to pass to CopyTrailers. It must be called before
+// w.WriteHeader.
+func AnnounceTrailers(w http.ResponseWriter, resp *http.Response) int {
+	if len(resp.Trailer) == 0 {
+		return 0
+	}
+	w.Header().Set("Trailer", strings.Join(TrailerNames(resp.Trailer), ", "))
+	return len(resp.Trailer)
+}
+
+// CopyTrailers sends trailers of resp to the client once its body is
+// read to the end, including ones not announced beforehand.
+func CopyTrailers(w http.ResponseWriter, resp *http.Response, announced int) {
+	for name, values := range resp.Trailer {
+		if len(resp.Trailer) != announced {
+			name = http.TrailerPrefix + name
+		}
+		w.Header()[name] = append([]string(nil), values...)
+	}
+}
+
+// TrailerNames returns sorted names of trailer.
+func TrailerNames(trailer http.Header) []string {
+	names := make([]string, 0, len(trailer))
+	for name := range trailer {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
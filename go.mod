@@ -1,3 +1,8 @@
 module github.com/olomix/dumpproxy
 
-go 1.12
+go 1.22
+
+require (
+	github.com/andybalholm/brotli v1.2.0
+	github.com/klauspost/compress v1.18.0
+)
@@ -0,0 +1,476 @@
+// Package dumpproxy implements a reverse proxy handing every proxied
+// exchange to a Sink, e.g. FileSink dumping it to files the way the
+// dumpproxy command does.
+package dumpproxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultMaxBodySize is the limit of bodies kept in exchanges if
+// Proxy.MaxBodySize is 0.
+const DefaultMaxBodySize = 10 << 20
+
+// ErrAbortResponse cuts a response off when the ResponseWriter fails a
+// write with an error wrapping it: the rest of the upstream response is
+// neither read nor dumped and the upstream request is canceled. Unlike
+// other client errors it doesn't fail the exchange, it's its ClientErr.
+var ErrAbortResponse = errors.New("dumpproxy: response aborted")
+
+// Exchange is a request proxied upstream together with its response.
+// Request and Response bodies are already consumed, sinks other than
+// StreamingSink get their content in RequestBody and ResponseBody.
+type Exchange struct {
+	Started time.Time
+	// ResponseStarted is when upstream response headers arrived, it's zero
+	// if they didn't.
+	ResponseStarted time.Time
+	Duration        time.Duration
+
+	// Request is the request as received from the client.
+	Request *http.Request
+	// UpstreamRequest is the request sent upstream: its URL points to the
+	// upstream, hop-by-hop headers are removed and X-Forwarded-For and
+	// X-Forwarded-Proto are added.
+	UpstreamRequest *http.Request
+	RequestBody     []byte
+	// Response is the upstream response as received, its body is not
+	// decoded.
+	Response     *http.Response
+	ResponseBody []byte
+	// BodiesTruncated is set if any of bodies is longer than
+	// Proxy.MaxBodySize and only its beginning is kept.
+	BodiesTruncated bool
+
+	// StatusCode is the status sent to the client, it's set even if the
+	// upstream never responded.
+	StatusCode int
+	// Err is why the exchange failed, nil if it was completely captured.
+	Err error
+	// ClientErr is why relaying the response to the client failed, the
+	// rest of the response is still captured.
+	ClientErr error
+}
+
+// Sink stores proxied exchanges.
+type Sink interface {
+	// WriteExchange is called once the response is relayed to the client.
+	// Exchanges that were not completely captured because of upstream or
+	// client errors are not written.
+	WriteExchange(ctx context.Context, ex *Exchange) error
+}
+
+// SinkFunc is a Sink calling itself.
+type SinkFunc func(ctx context.Context, ex *Exchange) error
+
+// WriteExchange calls f(ctx, ex).
+func (f SinkFunc) WriteExchange(ctx context.Context, ex *Exchange) error {
+	return f(ctx, ex)
+}
+
+// StreamingSink is a Sink storing bodies as they are proxied, so they are
+// never buffered in memory. Proxy calls OpenExchange instead of
+// WriteExchange for such sinks.
+type StreamingSink interface {
+	Sink
+	// OpenExchange is called before the request is sent upstream, ex has
+	// Started, Request and UpstreamRequest set. A nil ExchangeWriter skips
+	// the exchange.
+	OpenExchange(ctx context.Context, ex *Exchange) (ExchangeWriter, error)
+}
+
+// ExchangeWriter stores an exchange opened by a StreamingSink.
+type ExchangeWriter interface {
+	// RequestBody returns the writer the request body is copied to as it
+	// is sent upstream.
+	RequestBody() io.Writer
+	// WriteResponse is called once upstream response headers arrive. It
+	// returns the writer the response body is copied to as it is relayed
+	// to the client.
+	WriteResponse(resp *http.Response) (io.Writer, error)
+	// Close is called once the exchange is over, even if it failed. By
+	// then trailers of the request and the response are known.
+	Close(ex *Exchange) error
+}
+
+// FrameWriter is implemented by ExchangeWriters storing WebSocket frames
+// relayed after the upstream switched protocols.
+type FrameWriter interface {
+	WriteFrame(f *Frame) error
+}
+
+// StreamExchange writes an exchange with bodies in RequestBody and
+// ResponseBody to s, so a StreamingSink can implement WriteExchange.
+func StreamExchange(ctx context.Context, s StreamingSink, ex *Exchange) error {
+	ew, err := s.OpenExchange(ctx, ex)
+	if err != nil || ew == nil {
+		return err
+	}
+	_, err = ew.RequestBody().Write(ex.RequestBody)
+	if err == nil {
+		var body io.Writer
+		if body, err = ew.WriteResponse(ex.Response); err == nil {
+			_, err = body.Write(ex.ResponseBody)
+		}
+	}
+	if err != nil {
+		failed := *ex
+		failed.Err = err
+		_ = ew.Close(&failed)
+		return err
+	}
+	return ew.Close(ex)
+}
+
+// Resolver picks the upstream a request is proxied to. Only scheme and
+// host of the returned URL are used, the path and query are the ones of
+// the request.
+type Resolver interface {
+	Resolve(r *http.Request) (*url.URL, error)
+}
+
+// ResolverFunc is a Resolver calling itself.
+type ResolverFunc func(r *http.Request) (*url.URL, error)
+
+// Resolve calls f(r).
+func (f ResolverFunc) Resolve(r *http.Request) (*url.URL, error) {
+	return f(r)
+}
+
+// StaticUpstream returns a Resolver sending all requests to upstream.
+func StaticUpstream(upstream *url.URL) Resolver {
+	return ResolverFunc(func(*http.Request) (*url.URL, error) {
+		return upstream, nil
+	})
+}
+
+// defaultTransport passes compressed bodies through untouched and doesn't
+// ask upstreams for compression clients didn't ask for.
+var defaultTransport http.RoundTripper = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		DualStack: true,
+	}).DialContext,
+	MaxIdleConns:          100,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ExpectContinueTimeout: 1 * time.Second,
+	DisableCompression:    true,
+}
+
+// Proxy is an http.Handler proxying requests to the upstream picked by
+// Upstream and writing exchanges to Sink. The Host header of requests is
+// kept, hop-by-hop headers are not forwarded, redirects are passed to the
+// client. Responses are flushed to the client as they arrive. Protocol
+// upgrades like WebSocket are relayed, frames are handed to
+// ExchangeWriters implementing FrameWriter.
+type Proxy struct {
+	Upstream Resolver
+	Sink     Sink
+	// Transport sends requests upstream, a transport like
+	// http.DefaultTransport but without compression is used if nil.
+	Transport http.RoundTripper
+	// MaxBodySize limits bodies kept in exchanges written to sinks other
+	// than StreamingSink, 0 means DefaultMaxBodySize and a negative value
+	// means no limit. Clients always get whole bodies.
+	MaxBodySize int64
+	// Finished is called once the exchange is over, whether it was written
+	// to Sink or not, e.g. to log it.
+	Finished func(ex *Exchange)
+	// ErrorLog logs failed exchanges unless Finished is set, the standard
+	// logger is used if nil.
+	ErrorLog *log.Logger
+	// Context cancels upstream requests still running once it's done, e.g.
+	// on shutdown. Upstream requests don't end with the client connection,
+	// so responses of clients that went away are still dumped.
+	Context context.Context
+}
+
+// NewProxy returns a Proxy sending requests to upstream and writing
+// exchanges to sink.
+func NewProxy(upstream *url.URL, sink Sink) *Proxy {
+	return &Proxy{Upstream: StaticUpstream(upstream), Sink: sink}
+}
+
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ex := &Exchange{Started: time.Now(), Request: r}
+	defer p.finish(ex)
+
+	upstream, err := p.Upstream.Resolve(r)
+	if err != nil {
+		p.fail(w, ex, http.StatusBadGateway, err)
+		return
+	}
+
+	target := *r.URL
+	target.Scheme = upstream.Scheme
+	target.Host = upstream.Host
+	cr, err := http.NewRequest(r.Method, target.String(), nil)
+	if err != nil {
+		p.fail(w, ex, http.StatusBadGateway, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	defer cancel()
+	if p.Context != nil {
+		defer context.AfterFunc(p.Context, cancel)()
+	}
+	cr = cr.WithContext(ctx)
+	cr.Host = r.Host
+	cr.ContentLength = r.ContentLength
+	// Filled once the body is read.
+	cr.Trailer = r.Trailer
+	for header, values := range r.Header {
+		cr.Header[header] = append([]string(nil), values...)
+	}
+	RemoveHopHeaders(cr.Header)
+	AddForwardedHeaders(cr.Header, r)
+	ex.UpstreamRequest = cr
+
+	ew, err := p.openExchange(r.Context(), ex)
+	if err != nil {
+		p.fail(w, ex, http.StatusInternalServerError, err)
+		return
+	}
+	defer p.closeExchange(ew, ex)
+
+	cr.Body = http.NoBody
+	if r.ContentLength != 0 {
+		cr.Body = ioutil.NopCloser(io.TeeReader(r.Body, ew.RequestBody()))
+	}
+
+	resp, err := p.transport().RoundTrip(cr)
+	if err != nil {
+		p.fail(w, ex, http.StatusBadGateway, err)
+		return
+	}
+	defer closeLogError(p, resp.Body)
+	ex.ResponseStarted = time.Now()
+	ex.Response = resp
+
+	RemoveHopHeaders(resp.Header)
+	body, err := ew.WriteResponse(resp)
+	if err != nil {
+		p.fail(w, ex, http.StatusInternalServerError, err)
+		return
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		ex.StatusCode = resp.StatusCode
+		ex.Err = p.relayUpgrade(w, resp, ew)
+		return
+	}
+
+	for header, values := range resp.Header {
+		w.Header()[header] = append([]string(nil), values...)
+	}
+	announced := AnnounceTrailers(w, resp)
+	w.WriteHeader(resp.StatusCode)
+	ex.StatusCode = resp.StatusCode
+	// Clients of long polls and event streams get headers right away.
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	ex.ClientErr, ex.Err = copyBody(w, resp.Body, body)
+	if errors.Is(ex.ClientErr, ErrAbortResponse) {
+		cancel()
+	}
+	if ex.Err == nil && ex.ClientErr == nil {
+		CopyTrailers(w, resp, announced)
+	}
+}
+
+func (p *Proxy) transport() http.RoundTripper {
+	if p.Transport != nil {
+		return p.Transport
+	}
+	return defaultTransport
+}
+
+// openExchange returns the writer of the exchange, bodies are buffered
+// for sinks that don't stream them.
+func (p *Proxy) openExchange(
+	ctx context.Context,
+	ex *Exchange,
+) (ExchangeWriter, error) {
+	ss, ok := p.Sink.(StreamingSink)
+	if !ok {
+		limit := p.MaxBodySize
+		if limit == 0 {
+			limit = DefaultMaxBodySize
+		}
+		return &bufferedExchange{
+			ctx:      ctx,
+			sink:     p.Sink,
+			reqBody:  limitedBuffer{limit: limit},
+			respBody: limitedBuffer{limit: limit},
+		}, nil
+	}
+
+	ew, err := ss.OpenExchange(ctx, ex)
+	if err != nil {
+		return nil, err
+	}
+	if ew == nil {
+		return skippedExchange{}, nil
+	}
+	return ew, nil
+}
+
+func (p *Proxy) closeExchange(ew ExchangeWriter, ex *Exchange) {
+	ex.Duration = time.Since(ex.Started)
+	if err := ew.Close(ex); err != nil {
+		p.logf(
+			"dumpproxy: write exchange %v %v: %v",
+			ex.Request.Method, ex.Request.URL, err,
+		)
+	}
+}
+
+// fail responds with statusCode to an exchange that failed before the
+// upstream response was relayed.
+func (p *Proxy) fail(
+	w http.ResponseWriter,
+	ex *Exchange,
+	statusCode int,
+	err error,
+) {
+	ex.StatusCode = statusCode
+	ex.Err = err
+	w.WriteHeader(statusCode)
+}
+
+func (p *Proxy) finish(ex *Exchange) {
+	ex.Duration = time.Since(ex.Started)
+	if p.Finished != nil {
+		p.Finished(ex)
+		return
+	}
+	err := ex.Err
+	if err == nil {
+		err = ex.ClientErr
+	}
+	if err != nil {
+		p.logf("dumpproxy: %v %v: %v", ex.Request.Method, ex.Request.URL, err)
+	}
+}
+
+// copyBody relays the response body to the dump and the client, flushing
+// every chunk to the client. Once writing to the client fails the rest of
+// the body only goes to the dump, clientErr is that failure, unless it's
+// ErrAbortResponse which stops copying.
+func copyBody(
+	w http.ResponseWriter,
+	body io.Reader,
+	dump io.Writer,
+) (clientErr, err error) {
+	buf := make([]byte, 16384)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			if _, err = dump.Write(buf[:n]); err != nil {
+				return clientErr, err
+			}
+			if clientErr == nil {
+				_, clientErr = w.Write(buf[:n])
+				if errors.Is(clientErr, ErrAbortResponse) {
+					return clientErr, nil
+				}
+			}
+			if f, ok := w.(http.Flusher); ok && clientErr == nil {
+				f.Flush()
+			}
+		}
+		if readErr == io.EOF {
+			return clientErr, nil
+		}
+		if readErr != nil {
+			return clientErr, readErr
+		}
+	}
+}
+
+func (p *Proxy) logf(format string, args ...interface{}) {
+	if p.ErrorLog != nil {
+		p.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+func closeLogError(p *Proxy, closer io.Closer) {
+	if err := closer.Close(); err != nil {
+		p.logf("dumpproxy: %v", err)
+	}
+}
+
+// bufferedExchange keeps bodies in memory and writes completed exchanges
+// to a Sink.
+type bufferedExchange struct {
+	ctx      context.Context
+	sink     Sink
+	reqBody  limitedBuffer
+	respBody limitedBuffer
+}
+
+func (be *bufferedExchange) RequestBody() io.Writer {
+	return &be.reqBody
+}
+
+func (be *bufferedExchange) WriteResponse(*http.Response) (io.Writer, error) {
+	return &be.respBody, nil
+}
+
+func (be *bufferedExchange) Close(ex *Exchange) error {
+	if ex.Err != nil {
+		return nil
+	}
+	ex.RequestBody = be.reqBody.Bytes()
+	ex.ResponseBody = be.respBody.Bytes()
+	ex.BodiesTruncated = be.reqBody.truncated || be.respBody.truncated
+	return be.sink.WriteExchange(be.ctx, ex)
+}
+
+// skippedExchange is the writer of exchanges a StreamingSink doesn't
+// store.
+type skippedExchange struct{}
+
+func (skippedExchange) RequestBody() io.Writer { return ioutil.Discard }
+
+func (skippedExchange) WriteResponse(*http.Response) (io.Writer, error) {
+	return ioutil.Discard, nil
+}
+
+func (skippedExchange) Close(*Exchange) error { return nil }
+
+// limitedBuffer keeps the first limit bytes written to it, all of them
+// if limit is negative.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit     int64
+	truncated bool
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if lb.limit >= 0 {
+		if rest := lb.limit - int64(lb.Len()); int64(len(p)) > rest {
+			p = p[:rest]
+			lb.truncated = true
+		}
+	}
+	_, _ = lb.Buffer.Write(p)
+	return n, nil
+}
@@ -0,0 +1,351 @@
+package dumpproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestProxy starts upstream and a proxy in front of it writing
+// exchanges to sink.
+func newTestProxy(
+	t *testing.T,
+	upstream http.HandlerFunc,
+	p *Proxy,
+) (*httptest.Server, func()) {
+	us := httptest.NewServer(upstream)
+	upstreamURL, err := url.Parse(us.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Upstream = StaticUpstream(upstreamURL)
+	ps := httptest.NewServer(p)
+	return ps, func() {
+		ps.Close()
+		us.Close()
+	}
+}
+
+// collect returns a sink appending exchanges to exchanges.
+func collect(exchanges *[]*Exchange) Sink {
+	return SinkFunc(func(_ context.Context, ex *Exchange) error {
+		*exchanges = append(*exchanges, ex)
+		return nil
+	})
+}
+
+func TestProxyServeHTTP(t *testing.T) {
+	var exchanges []*Exchange
+	ps, stop := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Connection") != "" || r.Header.Get("X-Hop") != "" {
+			t.Errorf("hop-by-hop headers forwarded: %v", r.Header)
+		}
+		if r.Header.Get("X-Forwarded-For") != "127.0.0.1" {
+			t.Errorf(
+				"X-Forwarded-For = %q", r.Header.Get("X-Forwarded-For"),
+			)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", "1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("got " + string(body)))
+	}, &Proxy{Sink: collect(&exchanges)})
+
+	req, err := http.NewRequest(
+		http.MethodPost, ps.URL+"/path?q=1", strings.NewReader("hello"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "X-Hop")
+	req.Header.Set("X-Hop", "1")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	// Waits for the exchange to be written.
+	stop()
+
+	if resp.StatusCode != http.StatusCreated || string(body) != "got hello" {
+		t.Fatalf("got %v %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("X-Upstream") != "1" {
+		t.Errorf("upstream headers not relayed: %v", resp.Header)
+	}
+	if len(exchanges) != 1 {
+		t.Fatalf("got %v exchanges", len(exchanges))
+	}
+	ex := exchanges[0]
+	if ex.Request.URL.RequestURI() != "/path?q=1" {
+		t.Errorf("request URI = %v", ex.Request.URL.RequestURI())
+	}
+	if string(ex.RequestBody) != "hello" {
+		t.Errorf("request body = %q", ex.RequestBody)
+	}
+	if string(ex.ResponseBody) != "got hello" {
+		t.Errorf("response body = %q", ex.ResponseBody)
+	}
+	if ex.StatusCode != http.StatusCreated || ex.Err != nil {
+		t.Errorf("status = %v, err = %v", ex.StatusCode, ex.Err)
+	}
+	if ex.BodiesTruncated {
+		t.Error("bodies truncated")
+	}
+}
+
+func TestProxyMaxBodySize(t *testing.T) {
+	var exchanges []*Exchange
+	ps, stop := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("0123456789"))
+	}, &Proxy{Sink: collect(&exchanges), MaxBodySize: 4})
+
+	resp, err := http.Get(ps.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	// Waits for the exchange to be written.
+	stop()
+
+	if string(body) != "0123456789" {
+		t.Errorf("client got %q", body)
+	}
+	if len(exchanges) != 1 {
+		t.Fatalf("got %v exchanges", len(exchanges))
+	}
+	if string(exchanges[0].ResponseBody) != "0123" {
+		t.Errorf("response body = %q", exchanges[0].ResponseBody)
+	}
+	if !exchanges[0].BodiesTruncated {
+		t.Error("bodies not truncated")
+	}
+}
+
+func TestProxyUpstreamFailure(t *testing.T) {
+	var exchanges []*Exchange
+	var finished *Exchange
+	p := &Proxy{
+		Upstream: StaticUpstream(&url.URL{Scheme: "http", Host: "127.0.0.1:1"}),
+		Sink:     collect(&exchanges),
+		Finished: func(ex *Exchange) { finished = ex },
+	}
+	ps := httptest.NewServer(p)
+
+	resp, err := http.Get(ps.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	ps.Close()
+
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %v", resp.StatusCode)
+	}
+	if len(exchanges) != 0 {
+		t.Errorf("failed exchange written to sink")
+	}
+	if finished == nil || finished.Err == nil {
+		t.Errorf("Finished didn't get the failed exchange")
+	}
+}
+
+func TestProxyTrailers(t *testing.T) {
+	var exchanges []*Exchange
+	ps, stop := newTestProxy(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		_, _ = w.Write([]byte("body"))
+		w.Header().Set("X-Checksum", "abc")
+	}, &Proxy{Sink: collect(&exchanges)})
+
+	resp, err := http.Get(ps.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	stop()
+
+	if resp.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("client trailers = %v", resp.Trailer)
+	}
+	if len(exchanges) != 1 {
+		t.Fatalf("got %v exchanges", len(exchanges))
+	}
+	if exchanges[0].Response.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("exchange trailers = %v", exchanges[0].Response.Trailer)
+	}
+}
+
+// failingWriter is a client that went away before the body was relayed.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("client is gone")
+}
+
+func TestProxyClientGone(t *testing.T) {
+	var exchanges []*Exchange
+	us := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("response"))
+		},
+	))
+	defer us.Close()
+	upstreamURL, err := url.Parse(us.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy(upstreamURL, collect(&exchanges))
+
+	p.ServeHTTP(
+		failingWriter{httptest.NewRecorder()},
+		httptest.NewRequest(http.MethodGet, "/", nil),
+	)
+
+	if len(exchanges) != 1 {
+		t.Fatalf("got %v exchanges", len(exchanges))
+	}
+	ex := exchanges[0]
+	if ex.Err != nil || ex.ClientErr == nil {
+		t.Errorf("err = %v, client err = %v", ex.Err, ex.ClientErr)
+	}
+	if string(ex.ResponseBody) != "response" {
+		t.Errorf("response body = %q", ex.ResponseBody)
+	}
+}
+
+func TestProxyClientDisconnect(t *testing.T) {
+	exchanges := make(chan *Exchange, 1)
+	clientGone := make(chan struct{})
+	us := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("first,"))
+			w.(http.Flusher).Flush()
+			<-clientGone
+			_, _ = w.Write([]byte("rest"))
+		},
+	))
+	defer us.Close()
+	upstreamURL, err := url.Parse(us.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy(
+		upstreamURL,
+		SinkFunc(func(_ context.Context, ex *Exchange) error {
+			exchanges <- ex
+			return nil
+		}),
+	)
+	p.Finished = func(ex *Exchange) {
+		if ex.Err != nil {
+			t.Errorf("exchange failed: %v", ex.Err)
+			close(exchanges)
+		}
+	}
+	ps := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			go func() {
+				// The server cancels the context once the client is gone.
+				<-r.Context().Done()
+				close(clientGone)
+			}()
+			p.ServeHTTP(w, r)
+		},
+	))
+	defer ps.Close()
+
+	conn, err := net.Dial("tcp", ps.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := make([]byte, len("first,"))
+	if _, err = io.ReadFull(resp.Body, first); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case ex, ok := <-exchanges:
+		if ok && string(ex.ResponseBody) != "first,rest" {
+			t.Errorf("response body = %q", ex.ResponseBody)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("exchange was not written")
+	}
+}
+
+// abortingWriter fails every write with ErrAbortResponse.
+type abortingWriter struct {
+	http.ResponseWriter
+}
+
+func (abortingWriter) Write([]byte) (int, error) {
+	return 0, fmt.Errorf("test: %w", ErrAbortResponse)
+}
+
+func TestProxyAbortResponse(t *testing.T) {
+	var exchanges []*Exchange
+	canceled := make(chan struct{})
+	us := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("event"))
+			w.(http.Flusher).Flush()
+			// An endless stream only ends when the proxy cancels it.
+			<-r.Context().Done()
+			close(canceled)
+		},
+	))
+	defer us.Close()
+	upstreamURL, err := url.Parse(us.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy(upstreamURL, collect(&exchanges))
+
+	p.ServeHTTP(
+		abortingWriter{httptest.NewRecorder()},
+		httptest.NewRequest(http.MethodGet, "/", nil),
+	)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not canceled")
+	}
+
+	if len(exchanges) != 1 {
+		t.Fatalf("got %v exchanges", len(exchanges))
+	}
+	ex := exchanges[0]
+	if ex.Err != nil || !errors.Is(ex.ClientErr, ErrAbortResponse) {
+		t.Errorf("err = %v, client err = %v", ex.Err, ex.ClientErr)
+	}
+	if string(ex.ResponseBody) != "event" {
+		t.Errorf("response body = %q", ex.ResponseBody)
+	}
+}
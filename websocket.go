@@ -0,0 +1,200 @@
+package dumpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// MaxFramePayload limits the part of a frame payload handed to
+// FrameWriter. Frames are always relayed in full.
+const MaxFramePayload = 1024 * 1024
+
+// Frame is a WebSocket frame relayed after a protocol upgrade.
+type Frame struct {
+	Time       time.Time
+	FromClient bool
+	Opcode     byte
+	Fin        bool
+	// Length is the full payload length, Payload is unmasked and keeps at
+	// most MaxFramePayload bytes of it.
+	Length  uint64
+	Payload []byte
+}
+
+// relayUpgrade completes a protocol switch accepted by the upstream and
+// relays the connection in both directions. WebSocket frames are handed
+// to ew if it's a FrameWriter.
+func (p *Proxy) relayUpgrade(
+	w http.ResponseWriter,
+	resp *http.Response,
+	ew ExchangeWriter,
+) error {
+	upstream, ok := resp.Body.(io.ReadWriter)
+	if !ok {
+		return errors.New("upstream connection is not writable")
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return errors.New("connection doesn't support hijacking")
+	}
+
+	client, buf, err := hijacker.Hijack()
+	if err != nil {
+		return err
+	}
+	defer func() { _ = client.Close() }()
+
+	if _, err = fmt.Fprintf(client, "HTTP/1.1 %v\r\n", resp.Status); err != nil {
+		return err
+	}
+	if err = resp.Header.Write(client); err != nil {
+		return err
+	}
+	if _, err = io.WriteString(client, "\r\n"); err != nil {
+		return err
+	}
+
+	relay := relayRaw
+	fw, ok := ew.(FrameWriter)
+	if ok && strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		relay = func(dst io.Writer, src io.Reader, fromClient bool) error {
+			return p.relayFrames(dst, src, fromClient, fw)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.logRelayError(relay(upstream, buf.Reader, true))
+		closeWrite(resp.Body)
+		close(done)
+	}()
+	p.logRelayError(relay(client, upstream, false))
+	closeWrite(client)
+	<-done
+	return nil
+}
+
+func relayRaw(dst io.Writer, src io.Reader, _ bool) error {
+	_, err := io.Copy(dst, src)
+	return err
+}
+
+// relayFrames copies WebSocket frames from src to dst and hands each of
+// them to fw.
+func (p *Proxy) relayFrames(
+	dst io.Writer,
+	src io.Reader,
+	fromClient bool,
+	fw FrameWriter,
+) error {
+	br := bufio.NewReader(src)
+	for {
+		hdr := make([]byte, 2, 14)
+		if _, err := io.ReadFull(br, hdr); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		extLen := 0
+		switch hdr[1] & 0x7f {
+		case 126:
+			extLen = 2
+		case 127:
+			extLen = 8
+		}
+		masked := hdr[1]&0x80 != 0
+		if masked {
+			extLen += 4
+		}
+		hdr = hdr[:2+extLen]
+		if _, err := io.ReadFull(br, hdr[2:]); err != nil {
+			return err
+		}
+
+		length := uint64(hdr[1] & 0x7f)
+		switch length {
+		case 126:
+			length = uint64(binary.BigEndian.Uint16(hdr[2:4]))
+		case 127:
+			length = binary.BigEndian.Uint64(hdr[2:10])
+		}
+
+		if _, err := dst.Write(hdr); err != nil {
+			return err
+		}
+		var payload bytes.Buffer
+		_, err := io.CopyN(
+			io.MultiWriter(dst, &limitedWriter{&payload, MaxFramePayload}),
+			br, int64(length),
+		)
+		if err != nil {
+			return err
+		}
+
+		if masked {
+			mask := hdr[len(hdr)-4:]
+			data := payload.Bytes()
+			for i := range data {
+				data[i] ^= mask[i%4]
+			}
+		}
+		err = fw.WriteFrame(&Frame{
+			Time:       time.Now(),
+			FromClient: fromClient,
+			Opcode:     hdr[0] & 0x0f,
+			Fin:        hdr[0]&0x80 != 0,
+			Length:     length,
+			Payload:    payload.Bytes(),
+		})
+		// The connection goes on even if the frame is not stored.
+		p.logRelayError(err)
+	}
+}
+
+// closeWrite shuts down the writing side of conn if it supports that and
+// closes it otherwise.
+func closeWrite(conn io.Closer) {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		// Fails if the peer is already gone, nothing to do about it.
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = conn.Close()
+}
+
+func (p *Proxy) logRelayError(err error) {
+	if err != nil {
+		p.logf("dumpproxy: relay: %v", err)
+	}
+}
+
+// limitedWriter keeps at most n bytes and silently drops the rest.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	if lw.n <= 0 {
+		return len(p), nil
+	}
+	data := p
+	if len(data) > lw.n {
+		data = data[:lw.n]
+	}
+	n, err := lw.w.Write(data)
+	lw.n -= n
+	if err != nil {
+		return n, err
+	}
+	return len(p), nil
+}